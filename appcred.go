@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ApplicationCredential struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Secret      string `json:"secret"`
+	ExpiresAt   string `json:"expires_at"`
+	ProjectID   string `json:"project_id"`
+	Description string `json:"description"`
+}
+
+type applicationCredentialResponse struct {
+	ApplicationCredential ApplicationCredential `json:"application_credential"`
+}
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// CreateApplicationCredential creates an application credential for the
+// user, bound to the project the token is scoped to
+func (k *KeystoneClient) CreateApplicationCredential(token, userID string, appCred map[string]interface{}) (*ApplicationCredential, error) {
+	debugf("CreateApplicationCredential called for user %s\n", userID)
+
+	body, err := k.post("/v3/users/"+url.PathEscape(userID)+"/application_credentials", token, map[string]interface{}{
+		"application_credential": appCred,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var resp applicationCredentialResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse application credential response: %v", err)
+	}
+
+	debugf("Created application credential %s (ID: %s)\n", resp.ApplicationCredential.Name, resp.ApplicationCredential.ID)
+	return &resp.ApplicationCredential, nil
+}
+
+func runAppCred(args []string) {
+	if len(args) == 0 || args[0] != "create" {
+		fmt.Fprintf(os.Stderr, "Usage: %s appcred create [options] [credential]\n", os.Args[0])
+		os.Exit(1)
+	}
+	runAppCredCreate(args[1:])
+}
+
+func runAppCredCreate(args []string) {
+	fs := flag.NewFlagSet("appcred create", flag.ExitOnError)
+	name := fs.String("name", "", "Name of the application credential (required)")
+	description := fs.String("description", "", "Description of the application credential")
+	expires := fs.String("expires", "", "Expiry as a date (2006-01-02), RFC 3339 time, or duration from now (e.g. 90d, 12h)")
+	var roles stringList
+	fs.Var(&roles, "role", "Role to delegate, may be given more than once (default: all of your roles on the project)")
+	accessRules := fs.String("access-rules", "", "Access rules as a JSON list, or a file containing one")
+	unrestricted := fs.Bool("unrestricted", false, "Allow the application credential to create and delete other credentials")
+	entry := fs.String("entry", "", "Entry to save the credential to (default: <name>.openrc next to the source credential)")
+	force := fs.Bool("force", false, "Overwrite the entry if it already exists")
+	addAuthFlags(fs)
+	fs.Usage = func() {
+		printUsage(fs, "appcred create [options] [credential]")
+	}
+	fs.Parse(args)
+
+	DebugMode = debugMode
+
+	if *name == "" {
+		fmt.Fprintf(os.Stderr, "Error: --name is required\n")
+		os.Exit(1)
+	}
+
+	appCred := map[string]interface{}{
+		"name":         *name,
+		"unrestricted": *unrestricted,
+	}
+	if *description != "" {
+		appCred["description"] = *description
+	}
+	if *expires != "" {
+		expiresAt, err := parseExpiry(*expires, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --expires: %v\n", err)
+			os.Exit(1)
+		}
+		appCred["expires_at"] = expiresAt.UTC().Format(time.RFC3339)
+	}
+	if len(roles) > 0 {
+		var roleSpecs []map[string]string
+		for _, role := range roles {
+			roleSpecs = append(roleSpecs, map[string]string{"name": role})
+		}
+		appCred["roles"] = roleSpecs
+	}
+	if *accessRules != "" {
+		rules, err := loadAccessRules(*accessRules)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --access-rules: %v\n", err)
+			os.Exit(1)
+		}
+		appCred["access_rules"] = rules
+	}
+
+	store, credFile, creds := loadSelectedCredentials(fs.Args())
+	if creds.IsApplicationCredential() {
+		fmt.Fprintf(os.Stderr, "Error: application credentials must be created from a user credential\n")
+		os.Exit(1)
+	}
+
+	entryPath := *entry
+	if entryPath == "" {
+		entryPath = path.Join(path.Dir(credFile.Path), *name+".openrc")
+	}
+	entryPath = strings.TrimSuffix(entryPath, ".openrc") + ".openrc"
+	if err := checkEntry(entryPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid --entry: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Check before creating anything in Keystone, as the secret can't be
+	// retrieved again later
+	if !*force {
+		if store.Exists(entryPath) {
+			fmt.Fprintf(os.Stderr, "Error: entry %s already exists in %s (use --force to overwrite)\n", entryPath, store.Name())
+			os.Exit(1)
+		}
+	}
+
+	session := authenticate(credFile, creds)
+	if session.Scope != scopeProject {
+		fmt.Fprintf(os.Stderr, "Error: application credentials can only be created with a project scoped credential\n")
+		os.Exit(1)
+	}
+
+	created, err := session.Client.CreateApplicationCredential(session.Token, session.TokenResponse.Token.User.ID, appCred)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating application credential: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := store.Write(entryPath, applicationCredentialOpenrc(creds, created)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving application credential %s (ID: %s): %v\n", created.Name, created.ID, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Created application credential %s (ID: %s) for project %s\n", created.Name, created.ID, session.Project.Name)
+	fmt.Fprintf(os.Stderr, "Saved to %s as %s\n", store.Name(), entryPath)
+}
+
+// applicationCredentialOpenrc returns an openrc for the new application
+// credential, carrying over the cloud settings from the source credential
+func applicationCredentialOpenrc(creds *Credentials, appCred *ApplicationCredential) string {
+	var b strings.Builder
+	line := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "export %s=%s\n", key, bashEscape(value))
+		}
+	}
+
+	if appCred.Name != "" {
+		fmt.Fprintf(&b, "# Application credential %s", appCred.Name)
+		if appCred.ExpiresAt != "" {
+			fmt.Fprintf(&b, ", expires %s", appCred.ExpiresAt)
+		}
+		b.WriteString("\n")
+	}
+	line("OS_AUTH_URL", creds.AuthURL)
+	line("OS_AUTH_TYPE", "v3applicationcredential")
+	line("OS_IDENTITY_API_VERSION", "3")
+	line("OS_APPLICATION_CREDENTIAL_ID", appCred.ID)
+	line("OS_APPLICATION_CREDENTIAL_SECRET", appCred.Secret)
+	line("OS_REGION_NAME", creds.Region)
+	line("OS_CACERT", creds.CACert)
+	line("OS_CERT", creds.Cert)
+	line("OS_KEY", creds.Key)
+	if creds.Insecure {
+		line("OS_INSECURE", "true")
+	}
+	return b.String()
+}
+
+// parseExpiry accepts a date, an RFC 3339 time, or a duration from now with
+// an optional "d" suffix for days
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return time.Time{}, fmt.Errorf("%q is not a date, time or duration", value)
+		}
+		return now.AddDate(0, 0, n), nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return time.Time{}, fmt.Errorf("%q is not a date, time or duration", value)
+	}
+	return now.Add(d), nil
+}
+
+// loadAccessRules parses access rules given inline as JSON or in a file
+func loadAccessRules(value string) ([]interface{}, error) {
+	data := []byte(value)
+	if !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		var err error
+		data, err = os.ReadFile(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rules []interface{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
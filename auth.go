@@ -1,25 +1,35 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"strings"
+	"time"
 )
 
 var DebugMode bool
 
 type TokenResponse struct {
 	Token struct {
-		ID      string `json:"id"`
-		Expires string `json:"expires_at"`
-		Project struct {
+		ID       string   `json:"id"`
+		Expires  string   `json:"expires_at"`
+		IssuedAt string   `json:"issued_at"`
+		Methods  []string `json:"methods"`
+		AuditIDs []string `json:"audit_ids"`
+		Project  struct {
+			ID     string `json:"id"`
+			Name   string `json:"name"`
+			Domain struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"domain"`
+		} `json:"project"`
+		Domain struct {
 			ID   string `json:"id"`
 			Name string `json:"name"`
-		} `json:"project"`
-		User struct {
+		} `json:"domain"`
+		System map[string]interface{} `json:"system"`
+		User   struct {
 			ID     string `json:"id"`
 			Name   string `json:"name"`
 			Domain struct {
@@ -45,6 +55,54 @@ type TokenResponse struct {
 	} `json:"token"`
 }
 
+// ExpiresAt parses the token's expires_at, which Keystone may send without
+// the trailing Z
+func (t *TokenResponse) ExpiresAt() (time.Time, error) {
+	return time.Parse(time.RFC3339, strings.TrimSuffix(t.Token.Expires, "Z")+"Z")
+}
+
+// KeystoneError is returned when Keystone answers with an unexpected status,
+// so callers can act on the status code
+type KeystoneError struct {
+	Message    string
+	Status     string
+	StatusCode int
+	Body       string
+}
+
+func (e *KeystoneError) Error() string {
+	return fmt.Sprintf("%s: %s - %s", e.Message, e.Status, e.Body)
+}
+
+// RescopeError is returned by RescopeToken when Keystone refuses the scope
+// itself, rather than the credential it authenticates with first
+type RescopeError struct {
+	Err error
+}
+
+func (e *RescopeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RescopeError) Unwrap() error {
+	return e.Err
+}
+
+// IsKeystoneStatus reports whether err is a KeystoneError with one of the
+// given status codes
+func IsKeystoneStatus(err error, codes ...int) bool {
+	var ksErr *KeystoneError
+	if !errors.As(err, &ksErr) {
+		return false
+	}
+	for _, code := range codes {
+		if ksErr.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
 // strip / and /v3 from string
 func getUrlPath(uri string, suffix string) string {
 	trimmed := strings.TrimSuffix(uri, "/")
@@ -64,309 +122,485 @@ func getDomainSpec(creds *Credentials) map[string]interface{} {
 	}
 }
 
-func GetUnscopedToken(creds *Credentials) (string, error) {
-	debugf("GetUnscopedToken called for user %s\n", creds.Username)
+// getProjectDomainSpec returns the domain to find a project by name in,
+// falling back to the user's domain if no project domain is set
+func getProjectDomainSpec(creds *Credentials) map[string]interface{} {
+	if creds.ProjectDomainID != "" {
+		return map[string]interface{}{
+			"id": creds.ProjectDomainID,
+		}
+	}
+	if creds.ProjectDomainName != "" {
+		return map[string]interface{}{
+			"name": creds.ProjectDomainName,
+		}
+	}
+	return getDomainSpec(creds)
+}
+
+// projectNameScopeKey returns the cache key for a project found by name,
+// which includes its domain as project names are only unique within one
+func projectNameScopeKey(creds *Credentials, projectName string) string {
+	domain := getProjectDomainSpec(creds)
+	if id, ok := domain["id"]; ok {
+		return fmt.Sprintf("name:domain:%v/%s", id, projectName)
+	}
+	return fmt.Sprintf("name:domain-name:%v/%s", domain["name"], projectName)
+}
+
+// getCacheUser returns the user and user domain that key the token cache.
+// Application credentials are keyed by their ID as they carry no user.
+func getCacheUser(creds *Credentials) (string, string) {
+	if creds.IsApplicationCredential() {
+		return "appcred:" + creds.ApplicationCredentialID, ""
+	}
+	if creds.IsToken() {
+		return "token:" + creds.Token, ""
+	}
+	if creds.IsOIDC() {
+		return "oidc:" + creds.IdentityProvider + "/" + creds.Protocol + "/" + creds.ClientID, creds.Username
+	}
+	if creds.UserDomainId != "" {
+		return creds.Username, creds.UserDomainId
+	}
+	return creds.Username, creds.UserDomainName
+}
+
+// loadCachedScopedToken returns a still-valid cached token for the given
+// scope key, unless caching was disabled with --no-cache
+func loadCachedScopedToken(creds *Credentials, scopeKey string) (string, *TokenResponse, bool) {
+	if noCache {
+		debugf("Token cache disabled, requesting fresh token\n")
+		return "", nil, false
+	}
+	username, userDomain := getCacheUser(creds)
+	token, tokenResponse, ok := LoadCachedToken(creds.AuthURL, username, userDomain, scopeKey)
+	if ok {
+		debugf("Using cached token for scope %q (expires %s)\n", scopeKey, tokenResponse.Token.Expires)
+	}
+	return token, tokenResponse, ok
+}
+
+// saveScopedToken caches a freshly issued token. Failures only cost a
+// re-authentication next time, so they are not fatal.
+func saveScopedToken(creds *Credentials, scopeKey, token string, tokenResponse *TokenResponse) {
+	username, userDomain := getCacheUser(creds)
+	if err := SaveTokenToCache(creds.AuthURL, username, userDomain, scopeKey, token, tokenResponse); err != nil {
+		debugf("Failed to cache token: %v\n", err)
+	}
+}
+
+// ensureTOTPCode prompts for a TOTP code the first time one is needed, so
+// requests answered from the token cache don't ask for it
+func ensureTOTPCode(creds *Credentials) error {
+	if !creds.TOTPRequired || creds.TOTPCode != "" {
+		return nil
+	}
+
+	debugf("TOTP required, prompting user\n")
+	totpCode, err := PromptForTOTP()
+	if err != nil {
+		return fmt.Errorf("failed to read TOTP code: %w", err)
+	}
+	creds.TOTPCode = totpCode
+	debugf("TOTP code entered (length: %d)\n", len(totpCode))
+	return nil
+}
 
+// ensurePassword prompts for the password the first time one is needed, when
+// the openrc doesn't hold one
+func ensurePassword(creds *Credentials) error {
+	if !creds.NeedsPassword() {
+		return nil
+	}
+
+	debugf("No password in the credential file, prompting user\n")
+	password, err := PromptForPassword(creds.Username)
+	if err != nil {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+	if password == "" {
+		return fmt.Errorf("no password entered")
+	}
+	creds.Password = password
+	return nil
+}
+
+// passwordIdentity returns the password identity for the credentials, adding
+// the TOTP method when a code has been entered
+func passwordIdentity(creds *Credentials) map[string]interface{} {
 	methods := []string{"password"}
 	identity := map[string]interface{}{
-		"methods": methods,
-		"password": map[string]interface{}{
-			"user": map[string]interface{}{
-				"name":     creds.Username,
-				"domain":   getDomainSpec(creds),
-				"password": creds.Password,
-			},
-		},
+		"methods":  methods,
+		"password": passwordMethod(creds),
 	}
 
 	if creds.TOTPCode != "" {
-		debugf("Adding TOTP to authentication methods\n")
+		debugf("Adding TOTP to authentication methods (code length: %d)\n", len(creds.TOTPCode))
 		methods = append(methods, "totp")
 		identity["methods"] = methods
-		identity["totp"] = map[string]interface{}{
-			"user": map[string]interface{}{
-				"name":     creds.Username,
-				"domain":   getDomainSpec(creds),
-				"passcode": creds.TOTPCode,
-			},
-		}
+		identity["totp"] = totpMethod(creds)
 	}
 
 	debugf("Using authentication methods: %v\n", methods)
+	return identity
+}
 
-	authData := map[string]interface{}{
-		"auth": map[string]interface{}{
-			"identity": identity,
+func passwordMethod(creds *Credentials) map[string]interface{} {
+	return map[string]interface{}{
+		"user": map[string]interface{}{
+			"name":     creds.Username,
+			"domain":   getDomainSpec(creds),
+			"password": creds.Password,
 		},
 	}
+}
 
-	jsonData, err := json.Marshal(authData)
-	if err != nil {
-		return "", err
+func totpMethod(creds *Credentials) map[string]interface{} {
+	return map[string]interface{}{
+		"user": map[string]interface{}{
+			"name":     creds.Username,
+			"domain":   getDomainSpec(creds),
+			"passcode": creds.TOTPCode,
+		},
 	}
+}
 
-	url := getUrlPath(creds.AuthURL, "/v3/auth/tokens?nocatalog")
-	debugf("Making unscoped token request to: %s\n", url)
-	debugf("Request body: %s\n", string(jsonData))
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		debugf("HTTP request failed: %v\n", err)
+func (k *KeystoneClient) GetUnscopedToken(creds *Credentials) (string, error) {
+	debugf("GetUnscopedToken called for user %s\n", creds.Username)
+
+	if creds.IsToken() {
+		debugf("Using the provided token as the unscoped token\n")
+		return creds.Token, nil
+	}
+
+	if creds.IsOIDC() {
+		return k.GetFederatedToken(creds)
+	}
+
+	if err := ensurePassword(creds); err != nil {
+		return "", err
+	}
+	if err := ensureTOTPCode(creds); err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
 
-	debugf("HTTP response status: %s (%d)\n", resp.Status, resp.StatusCode)
+	authData := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": passwordIdentity(creds),
+		},
+	}
 
-	body, err := io.ReadAll(resp.Body)
+	token, _, err := k.requestToken("authentication", creds, authData, true)
 	if err != nil {
 		return "", err
 	}
 
-	if resp.StatusCode != http.StatusCreated {
-		debugf("Authentication failed with body: %s\n", string(body))
-		return "", fmt.Errorf("authentication failed: %s - %s", resp.Status, string(body))
+	debugf("Successfully obtained unscoped token\n")
+	return token, nil
+}
+
+// scopedIdentity returns the identity for a request that asks for a scoped
+// token directly. Federated credentials can't do that, so they first get an
+// unscoped token and authenticate with it instead.
+func (k *KeystoneClient) scopedIdentity(creds *Credentials) (map[string]interface{}, error) {
+	if creds.IsToken() {
+		return tokenIdentity(creds.Token), nil
 	}
 
-	token := resp.Header.Get("X-Subject-Token")
-	if token == "" {
-		debugf("No X-Subject-Token header received\n")
-		return "", fmt.Errorf("no token received")
+	if creds.IsOIDC() {
+		token, err := k.GetFederatedToken(creds)
+		if err != nil {
+			return nil, err
+		}
+		return tokenIdentity(token), nil
 	}
 
-	debugf("Successfully obtained unscoped token (length: %d)\n", len(token))
+	if err := ensurePassword(creds); err != nil {
+		return nil, err
+	}
+	if err := ensureTOTPCode(creds); err != nil {
+		return nil, err
+	}
+	return passwordIdentity(creds), nil
+}
 
-	return token, nil
+func tokenIdentity(token string) map[string]interface{} {
+	return map[string]interface{}{
+		"methods": []string{"token"},
+		"token": map[string]interface{}{
+			"id": token,
+		},
+	}
 }
 
-func GetApplicationCredentialToken(creds *Credentials) (string, *TokenResponse, error) {
+func (k *KeystoneClient) GetApplicationCredentialToken(creds *Credentials) (string, *TokenResponse, error) {
 	debugf("GetApplicationCredentialToken called for application credential %s\n", creds.ApplicationCredentialID)
 
-	methods := []string{"application_credential"}
-	identity := map[string]interface{}{
-		"methods": methods,
-		"application_credential": map[string]interface{}{
-			"id":     creds.ApplicationCredentialID,
-			"secret": creds.ApplicationCredentialSecret,
-		},
+	if token, tokenResponse, ok := loadCachedScopedToken(creds, ""); ok {
+		return token, tokenResponse, nil
 	}
 
 	authData := map[string]interface{}{
 		"auth": map[string]interface{}{
-			"identity": identity,
+			"identity": map[string]interface{}{
+				"methods": []string{"application_credential"},
+				"application_credential": map[string]interface{}{
+					"id":     creds.ApplicationCredentialID,
+					"secret": creds.ApplicationCredentialSecret,
+				},
+			},
 		},
 	}
 
-	jsonData, err := json.Marshal(authData)
+	token, tokenResponse, err := k.requestToken("application credential authentication", creds, authData, false)
 	if err != nil {
 		return "", nil, err
 	}
 
-	url := getUrlPath(creds.AuthURL, "/v3/auth/tokens")
-	debugf("Making application credential token request to: %s\n", url)
-	debugf("Request body: %s\n", string(jsonData))
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		debugf("HTTP request failed: %v\n", err)
-		return "", nil, err
-	}
-	defer resp.Body.Close()
+	debugf("Parsed token response - Project: %s (ID: %s)\n", tokenResponse.Token.Project.Name, tokenResponse.Token.Project.ID)
 
-	debugf("HTTP response status: %s (%d)\n", resp.Status, resp.StatusCode)
+	saveScopedToken(creds, "", token, tokenResponse)
+	return token, tokenResponse, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", nil, err
-	}
+func (k *KeystoneClient) GetScopedToken(creds *Credentials, projectID string) (string, *TokenResponse, error) {
+	debugf("GetScopedToken called for projectID: %s\n", projectID)
 
-	if resp.StatusCode != http.StatusCreated {
-		debugf("Application credential authentication failed with body: %s\n", string(body))
-		return "", nil, fmt.Errorf("application credential authentication failed: %s - %s", resp.Status, string(body))
+	scope := projectIDScope(projectID)
+	if token, tokenResponse, ok := loadCachedScopedToken(creds, scope.key); ok {
+		return token, tokenResponse, nil
 	}
 
-	token := resp.Header.Get("X-Subject-Token")
-	if token == "" {
-		debugf("No X-Subject-Token header received\n")
-		return "", nil, fmt.Errorf("no token received")
+	identity, err := k.scopedIdentity(creds)
+	if err != nil {
+		return "", nil, err
 	}
 
-	debugf("Successfully obtained application credential token (length: %d)\n", len(token))
-
-	var tokenResponse TokenResponse
-	if err := json.Unmarshal(body, &tokenResponse); err != nil {
-		debugf("Failed to parse token response: %v\n", err)
-		return "", nil, fmt.Errorf("failed to parse token response: %v", err)
+	authData := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": identity,
+			"scope":    scope.spec,
+		},
 	}
 
-	debugf("Parsed token response - Project: %s (ID: %s)\n", tokenResponse.Token.Project.Name, tokenResponse.Token.Project.ID)
+	token, tokenResponse, err := k.requestToken("scoped authentication", creds, authData, false)
+	if err != nil {
+		return "", nil, err
+	}
 
-	return token, &tokenResponse, nil
+	saveScopedToken(creds, scope.key, token, tokenResponse)
+	return token, tokenResponse, nil
 }
 
-func GetScopedToken(creds *Credentials, projectID string) (string, error) {
-	debugf("GetScopedToken called for projectID: %s - always requesting fresh token\n", projectID)
+func (k *KeystoneClient) GetScopedTokenByProjectName(creds *Credentials, projectName string) (string, *TokenResponse, error) {
+	debugf("GetScopedTokenByProjectName called for project: %s\n", projectName)
 
-	methods := []string{"password"}
-	identity := map[string]interface{}{
-		"methods": methods,
-		"password": map[string]interface{}{
-			"user": map[string]interface{}{
-				"name":     creds.Username,
-				"domain":   getDomainSpec(creds),
-				"password": creds.Password,
-			},
-		},
+	scopeKey := projectNameScopeKey(creds, projectName)
+	if token, tokenResponse, ok := loadCachedScopedToken(creds, scopeKey); ok {
+		return token, tokenResponse, nil
 	}
 
-	if creds.TOTPCode != "" {
-		debugf("Adding TOTP to scoped authentication (code length: %d)\n", len(creds.TOTPCode))
-		methods = append(methods, "totp")
-		identity["methods"] = methods
-		identity["totp"] = map[string]interface{}{
-			"user": map[string]interface{}{
-				"name":     creds.Username,
-				"domain":   getDomainSpec(creds),
-				"passcode": creds.TOTPCode,
-			},
-		}
+	identity, err := k.scopedIdentity(creds)
+	if err != nil {
+		return "", nil, err
 	}
 
-	debugf("Scoped auth using methods: %v\n", methods)
-
 	authData := map[string]interface{}{
 		"auth": map[string]interface{}{
 			"identity": identity,
 			"scope": map[string]interface{}{
 				"project": map[string]interface{}{
-					"id": projectID,
+					"name":   projectName,
+					"domain": getProjectDomainSpec(creds),
 				},
 			},
 		},
 	}
 
-	jsonData, err := json.Marshal(authData)
+	token, tokenResponse, err := k.requestToken("scoped authentication", creds, authData, false)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	url := getUrlPath(creds.AuthURL, "/v3/auth/tokens")
-	debugf("Making scoped token request to: %s\n", url)
-	debugf("Request body: %s\n", string(jsonData))
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		debugf("Scoped HTTP request failed: %v\n", err)
-		return "", err
-	}
-	defer resp.Body.Close()
+	debugf("Parsed token response - Project: %s (ID: %s)\n", tokenResponse.Token.Project.Name, tokenResponse.Token.Project.ID)
 
-	debugf("Scoped HTTP response status: %s (%d)\n", resp.Status, resp.StatusCode)
+	saveScopedToken(creds, scopeKey, token, tokenResponse)
+	return token, tokenResponse, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+// authReceiptHeader carries the receipt Keystone issues when an auth request
+// satisfies some, but not all, of the user's MFA rules
+const authReceiptHeader = "Openstack-Auth-Receipt"
+
+type authReceipt struct {
+	ID      string `json:"-"`
+	Receipt struct {
+		Methods   []string `json:"methods"`
+		ExpiresAt string   `json:"expires_at"`
+	} `json:"receipt"`
+	RequiredAuthMethods [][]string `json:"required_auth_methods"`
+}
+
+// missingMethods returns the methods still needed to satisfy the MFA rule
+// that needs the fewest further methods we can supply
+func (r *authReceipt) missingMethods() ([]string, error) {
+	satisfied := map[string]bool{}
+	for _, method := range r.Receipt.Methods {
+		satisfied[method] = true
+	}
+
+	var best []string
+	for _, rule := range r.RequiredAuthMethods {
+		var missing []string
+		supported := true
+		for _, method := range rule {
+			if satisfied[method] {
+				continue
+			}
+			if method != "password" && method != "totp" {
+				supported = false
+				break
+			}
+			missing = append(missing, method)
+		}
+		if supported && len(missing) > 0 && (best == nil || len(missing) < len(best)) {
+			best = missing
+		}
 	}
 
-	if resp.StatusCode != http.StatusCreated {
-		debugf("Scoped authentication failed with body: %s\n", string(body))
-		return "", fmt.Errorf("scoped authentication failed: %s - %s", resp.Status, string(body))
+	if best == nil {
+		return nil, fmt.Errorf("unsupported auth methods required by Keystone: %v", r.RequiredAuthMethods)
 	}
+	return best, nil
+}
 
-	token := resp.Header.Get("X-Subject-Token")
-	if token == "" {
-		return "", fmt.Errorf("no scoped token received")
+// receiptIdentity builds an identity with only the methods an auth receipt
+// says are still missing, prompting for a TOTP code if one hasn't been
+// entered yet
+func receiptIdentity(creds *Credentials, receipt *authReceipt) (map[string]interface{}, error) {
+	if creds == nil {
+		return nil, fmt.Errorf("further auth methods required by Keystone: %v", receipt.RequiredAuthMethods)
 	}
 
-	debugf("Successfully obtained scoped token (length: %d)\n", len(token))
+	missing, err := receipt.missingMethods()
+	if err != nil {
+		return nil, err
+	}
+	debugf("Auth receipt requires methods: %v\n", missing)
 
-	return token, nil
+	identity := map[string]interface{}{
+		"methods": missing,
+	}
+	for _, method := range missing {
+		switch method {
+		case "password":
+			if err := ensurePassword(creds); err != nil {
+				return nil, err
+			}
+			if creds.Password == "" {
+				return nil, fmt.Errorf("a password is required by Keystone but none is set")
+			}
+			identity["password"] = passwordMethod(creds)
+		case "totp":
+			if creds.TOTPCode == "" {
+				debugf("Auth receipt requires TOTP, prompting user\n")
+				totpCode, err := PromptForTOTP()
+				if err != nil {
+					return nil, fmt.Errorf("failed to read TOTP code: %w", err)
+				}
+				creds.TOTPCode = totpCode
+			}
+			identity["totp"] = totpMethod(creds)
+		}
+	}
+
+	return identity, nil
 }
 
-func GetScopedTokenByProjectName(creds *Credentials, projectName string) (string, *TokenResponse, error) {
-	debugf("GetScopedTokenByProjectName called for project: %s\n", projectName)
+// tokenScope is the scope section of a token request, along with the key its
+// token is cached under
+type tokenScope struct {
+	key  string
+	spec map[string]interface{}
+}
 
-	methods := []string{"password"}
-	identity := map[string]interface{}{
-		"methods": methods,
-		"password": map[string]interface{}{
-			"user": map[string]interface{}{
-				"name":     creds.Username,
-				"domain":   getDomainSpec(creds),
-				"password": creds.Password,
+func projectIDScope(projectID string) tokenScope {
+	return tokenScope{
+		key: projectID,
+		spec: map[string]interface{}{
+			"project": map[string]interface{}{
+				"id": projectID,
 			},
 		},
 	}
+}
 
-	if creds.TOTPCode != "" {
-		debugf("Adding TOTP to direct scoped authentication (code length: %d)\n", len(creds.TOTPCode))
-		methods = append(methods, "totp")
-		identity["methods"] = methods
-		identity["totp"] = map[string]interface{}{
-			"user": map[string]interface{}{
-				"name":     creds.Username,
-				"domain":   getDomainSpec(creds),
-				"passcode": creds.TOTPCode,
+// domainScope returns the domain scope from the credentials, preferring ID
+// over Name
+func domainScope(creds *Credentials) tokenScope {
+	if creds.DomainID != "" {
+		return tokenScope{
+			key: "domain:" + creds.DomainID,
+			spec: map[string]interface{}{
+				"domain": map[string]interface{}{
+					"id": creds.DomainID,
+				},
 			},
 		}
 	}
-
-	debugf("Direct scoped auth using methods: %v\n", methods)
-
-	scopeData := map[string]interface{}{
-		"project": map[string]interface{}{
-			"name":   projectName,
-			"domain": getDomainSpec(creds),
+	return tokenScope{
+		key: "domain-name:" + creds.DomainName,
+		spec: map[string]interface{}{
+			"domain": map[string]interface{}{
+				"name": creds.DomainName,
+			},
 		},
 	}
+}
 
-	authData := map[string]interface{}{
-		"auth": map[string]interface{}{
-			"identity": identity,
-			"scope":    scopeData,
+func systemScope(creds *Credentials) tokenScope {
+	return tokenScope{
+		key: "system:" + creds.SystemScope,
+		spec: map[string]interface{}{
+			"system": map[string]interface{}{
+				creds.SystemScope: true,
+			},
 		},
 	}
+}
 
-	jsonData, err := json.Marshal(authData)
-	if err != nil {
-		return "", nil, err
-	}
-
-	url := getUrlPath(creds.AuthURL, "/v3/auth/tokens?nocatalog")
-	debugf("Making direct scoped token request to: %s\n", url)
-	debugf("Request body: %s\n", string(jsonData))
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		debugf("Direct scoped HTTP request failed: %v\n", err)
-		return "", nil, err
-	}
-	defer resp.Body.Close()
-
-	debugf("Direct scoped HTTP response status: %s (%d)\n", resp.Status, resp.StatusCode)
+// RescopeToken exchanges an unscoped token for a scoped one using the token
+// auth method, so the password and TOTP code are only sent once per login. If
+// unscopedToken is empty, one is requested first, but only if there is no
+// cached token for the scope.
+func (k *KeystoneClient) RescopeToken(creds *Credentials, unscopedToken string, scope tokenScope) (string, *TokenResponse, error) {
+	debugf("RescopeToken called for scope: %s\n", scope.key)
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", nil, err
+	if token, tokenResponse, ok := loadCachedScopedToken(creds, scope.key); ok {
+		return token, tokenResponse, nil
 	}
 
-	if resp.StatusCode != http.StatusCreated {
-		debugf("Direct scoped authentication failed with body: %s\n", string(body))
-		return "", nil, fmt.Errorf("scoped authentication failed: %s - %s", resp.Status, string(body))
+	if unscopedToken == "" {
+		var err error
+		unscopedToken, err = k.GetUnscopedToken(creds)
+		if err != nil {
+			return "", nil, err
+		}
 	}
 
-	token := resp.Header.Get("X-Subject-Token")
-	if token == "" {
-		debugf("No X-Subject-Token header received in direct scoped response\n")
-		return "", nil, fmt.Errorf("no scoped token received")
+	authData := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": tokenIdentity(unscopedToken),
+			"scope":    scope.spec,
+		},
 	}
 
-	debugf("Successfully obtained direct scoped token (length: %d)\n", len(token))
-
-	var tokenResponse TokenResponse
-	if err := json.Unmarshal(body, &tokenResponse); err != nil {
-		debugf("Failed to parse direct scoped token response: %v\n", err)
-		return "", nil, fmt.Errorf("failed to parse token response: %v", err)
+	token, tokenResponse, err := k.requestToken("scoped authentication", creds, authData, false)
+	if err != nil {
+		return "", nil, &RescopeError{Err: err}
 	}
 
-	debugf("Parsed token response - Project: %s (ID: %s)\n", tokenResponse.Token.Project.Name, tokenResponse.Token.Project.ID)
-
-	debugf("Direct scoped authentication successful\n")
-	return token, &tokenResponse, nil
+	saveScopedToken(creds, scope.key, token, tokenResponse)
+	return token, tokenResponse, nil
 }
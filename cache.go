@@ -7,12 +7,15 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 )
 
 const CacheExpiryDays = 7
 
+// TokenCacheMinValidity is how long a cached token must still be valid for to
+// be reused, so it doesn't expire part way through the next command
+const TokenCacheMinValidity = 5 * time.Minute
+
 type CacheEntry struct {
 	Projects  []Project `json:"projects"`
 	Timestamp time.Time `json:"timestamp"`
@@ -20,9 +23,10 @@ type CacheEntry struct {
 }
 
 type TokenCacheEntry struct {
-	Token     string    `json:"token"`
-	ExpiresAt time.Time `json:"expires_at"`
-	CachedAt  time.Time `json:"cached_at"`
+	Token     string         `json:"token"`
+	ExpiresAt time.Time      `json:"expires_at"`
+	CachedAt  time.Time      `json:"cached_at"`
+	Response  *TokenResponse `json:"response,omitempty"`
 }
 
 func getCacheDir() (string, error) {
@@ -39,18 +43,21 @@ func getCacheDir() (string, error) {
 	return appCacheDir, os.MkdirAll(appCacheDir, 0755)
 }
 
-func getCacheFilePath(authURL string) (string, error) {
+// getCacheFilePath returns the project cache file, which is per user as well
+// as per cloud since project membership differs between users
+func getCacheFilePath(authURL, username, userDomain string) (string, error) {
 	cacheDir, err := getCacheDir()
 	if err != nil {
 		return "", err
 	}
 
-	filename := fmt.Sprintf("projects_%x.json", []byte(authURL))
+	key := generateTokenCacheKey(authURL, username, userDomain, "")
+	filename := fmt.Sprintf("projects_%s.json", key)
 	return filepath.Join(cacheDir, filename), nil
 }
 
-func LoadCachedProjects(authURL string) ([]Project, bool) {
-	cacheFile, err := getCacheFilePath(authURL)
+func LoadCachedProjects(authURL, username, userDomain string) ([]Project, bool) {
+	cacheFile, err := getCacheFilePath(authURL, username, userDomain)
 	if err != nil {
 		return nil, false
 	}
@@ -76,8 +83,8 @@ func LoadCachedProjects(authURL string) ([]Project, bool) {
 	return entry.Projects, true
 }
 
-func SaveProjectsToCache(authURL string, projectsList []Project) error {
-	cacheFile, err := getCacheFilePath(authURL)
+func SaveProjectsToCache(authURL, username, userDomain string, projectsList []Project) error {
+	cacheFile, err := getCacheFilePath(authURL, username, userDomain)
 	if err != nil {
 		return err
 	}
@@ -96,8 +103,8 @@ func SaveProjectsToCache(authURL string, projectsList []Project) error {
 	return os.WriteFile(cacheFile, data, 0644)
 }
 
-func ClearCache(authURL string) error {
-	cacheFile, err := getCacheFilePath(authURL)
+func ClearCache(authURL, username, userDomain string) error {
+	cacheFile, err := getCacheFilePath(authURL, username, userDomain)
 	if err != nil {
 		return err
 	}
@@ -130,38 +137,43 @@ func getTokenCacheFilePath(authURL, username, userDomain, projectID string) (str
 	return filepath.Join(cacheDir, filename), nil
 }
 
-func LoadCachedToken(authURL, username, userDomain, projectID string) (string, bool) {
+func LoadCachedToken(authURL, username, userDomain, projectID string) (string, *TokenResponse, bool) {
 	cacheFile, err := getTokenCacheFilePath(authURL, username, userDomain, projectID)
 	if err != nil {
-		return "", false
+		return "", nil, false
 	}
 
 	data, err := os.ReadFile(cacheFile)
 	if err != nil {
-		return "", false
+		return "", nil, false
 	}
 
 	var entry TokenCacheEntry
 	if err := json.Unmarshal(data, &entry); err != nil {
-		return "", false
+		return "", nil, false
 	}
 
-	now := time.Now()
-	if now.After(entry.ExpiresAt) {
+	if time.Now().Add(TokenCacheMinValidity).After(entry.ExpiresAt) {
 		os.Remove(cacheFile)
-		return "", false
+		return "", nil, false
+	}
+
+	if entry.Response == nil {
+		return "", nil, false
 	}
 
-	return entry.Token, true
+	return entry.Token, entry.Response, true
 }
 
-func SaveTokenToCache(authURL, username, userDomain, projectID, token, expiresAt string) error {
+// SaveTokenToCache stores a token along with the response it came with, using
+// the token's expires_at as the cache expiry
+func SaveTokenToCache(authURL, username, userDomain, projectID, token string, tokenResponse *TokenResponse) error {
 	cacheFile, err := getTokenCacheFilePath(authURL, username, userDomain, projectID)
 	if err != nil {
 		return err
 	}
 
-	expiryTime, err := time.Parse(time.RFC3339, strings.TrimSuffix(expiresAt, "Z")+"Z")
+	expiryTime, err := tokenResponse.ExpiresAt()
 	if err != nil {
 		return err
 	}
@@ -170,6 +182,7 @@ func SaveTokenToCache(authURL, username, userDomain, projectID, token, expiresAt
 		Token:     token,
 		ExpiresAt: expiryTime,
 		CachedAt:  time.Now(),
+		Response:  tokenResponse,
 	}
 
 	data, err := json.MarshalIndent(entry, "", "  ")
@@ -177,7 +190,8 @@ func SaveTokenToCache(authURL, username, userDomain, projectID, token, expiresAt
 		return err
 	}
 
-	return os.WriteFile(cacheFile, data, 0644)
+	// Tokens are bearer credentials, so keep them private to the user
+	return os.WriteFile(cacheFile, data, 0600)
 }
 
 func ClearTokenCache(authURL, username, userDomain, projectID string) error {
@@ -192,3 +206,37 @@ func ClearTokenCache(authURL, username, userDomain, projectID string) error {
 
 	return os.Remove(cacheFile)
 }
+
+// ClearCachedToken removes every token cache entry holding the given token,
+// for when it is revoked and the cache key that stored it isn't known
+func ClearCachedToken(token string) error {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return err
+	}
+
+	cacheFiles, err := filepath.Glob(filepath.Join(cacheDir, "token_*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, cacheFile := range cacheFiles {
+		data, err := os.ReadFile(cacheFile)
+		if err != nil {
+			continue
+		}
+
+		var entry TokenCacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+
+		if entry.Token == token {
+			if err := os.Remove(cacheFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -34,6 +34,14 @@ set -q CHCREDS_PS1_CRED_COLOR; or set -g CHCREDS_PS1_CRED_COLOR cyan
 set -q CHCREDS_PS1_SUFFIX_COLOR; or set -g CHCREDS_PS1_SUFFIX_COLOR ''
 set -q CHCREDS_PS1_BG_COLOR; or set -g CHCREDS_PS1_BG_COLOR ''
 
+# Token expiry countdown, shown when oscreds exports OS_CRED_EXPIRES_AT (with
+# --metadata). Within CHCREDS_PS1_EXPIRY_WARN seconds of expiry the credential
+# and countdown switch to CHCREDS_PS1_EXPIRY_WARN_COLOR.
+set -q CHCREDS_PS1_EXPIRY_ENABLE; or set -g CHCREDS_PS1_EXPIRY_ENABLE true
+set -q CHCREDS_PS1_EXPIRY_WARN; or set -g CHCREDS_PS1_EXPIRY_WARN 900
+set -q CHCREDS_PS1_EXPIRY_COLOR; or set -g CHCREDS_PS1_EXPIRY_COLOR ''
+set -q CHCREDS_PS1_EXPIRY_WARN_COLOR; or set -g CHCREDS_PS1_EXPIRY_WARN_COLOR red
+
 # Optional user hook functions (names of functions, not the code itself). Set
 # CHCREDS_PS1_CRED_COLOR_FUNCTION to a function that takes the credential name and
 # prints a colour to make the credential colour dynamic (e.g. by environment).
@@ -61,6 +69,28 @@ function _chcreds_ps1_colorize
     set_color normal
 end
 
+# --- Expiry helpers -----------------------------------------------------------
+
+# Print the seconds until an OS_CRED_EXPIRES_AT timestamp, using GNU or BSD
+# date. Prints nothing if the timestamp can't be parsed.
+function _chcreds_ps1_expires_in
+    set -l expires (date -u -d $argv[1] +%s 2>/dev/null; or date -u -j -f '%Y-%m-%dT%H:%M:%SZ' $argv[1] +%s 2>/dev/null)
+    or return
+    math $expires - (date +%s)
+end
+
+# Format a number of seconds as 1h05m, 12m or expired.
+function _chcreds_ps1_countdown
+    set -l secs $argv[1]
+    if test $secs -le 0
+        printf 'expired'
+    else if test $secs -ge 3600
+        printf '%dh%02dm' (math -s0 $secs / 3600) (math -s0 $secs % 3600 / 60)
+    else
+        printf '%dm' (math -s0 $secs / 60)
+    end
+end
+
 # --- Main function ------------------------------------------------------------
 
 function chcreds_ps1
@@ -82,6 +112,20 @@ function chcreds_ps1
         set cred_color ($CHCREDS_PS1_CRED_COLOR_FUNCTION $cred)
     end
 
+    # Expiry countdown, which overrides the cred colour when nearly expired.
+    set -l countdown ''
+    set -l expiry_color $CHCREDS_PS1_EXPIRY_COLOR
+    if test "$CHCREDS_PS1_EXPIRY_ENABLE" = true; and set -q OS_CRED_EXPIRES_AT
+        set -l expires_in (_chcreds_ps1_expires_in $OS_CRED_EXPIRES_AT)
+        if test -n "$expires_in"
+            set countdown (_chcreds_ps1_countdown $expires_in)
+            if test $expires_in -le $CHCREDS_PS1_EXPIRY_WARN
+                set cred_color $CHCREDS_PS1_EXPIRY_WARN_COLOR
+                set expiry_color $CHCREDS_PS1_EXPIRY_WARN_COLOR
+            end
+        end
+    end
+
     # Symbol.
     set -l symbol ''
     if test "$CHCREDS_PS1_SYMBOL_ENABLE" = true
@@ -102,5 +146,9 @@ function chcreds_ps1
         printf '%s' "$CHCREDS_PS1_SEPARATOR"
     end
     _chcreds_ps1_colorize "$cred_color" "$cred_disp"
+    if test -n "$countdown"
+        printf '%s' "$CHCREDS_PS1_SEPARATOR"
+        _chcreds_ps1_colorize "$expiry_color" "$countdown"
+    end
     _chcreds_ps1_colorize "$CHCREDS_PS1_SUFFIX_COLOR" "$CHCREDS_PS1_SUFFIX"
 end
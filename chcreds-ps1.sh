@@ -37,6 +37,14 @@
 : "${CHCREDS_PS1_SUFFIX_COLOR=}"
 : "${CHCREDS_PS1_BG_COLOR=}"
 
+# Token expiry countdown, shown when oscreds exports OS_CRED_EXPIRES_AT (with
+# --metadata). Within CHCREDS_PS1_EXPIRY_WARN seconds of expiry the credential
+# and countdown switch to CHCREDS_PS1_EXPIRY_WARN_COLOR.
+: "${CHCREDS_PS1_EXPIRY_ENABLE=true}"
+: "${CHCREDS_PS1_EXPIRY_WARN=900}"
+: "${CHCREDS_PS1_EXPIRY_COLOR=}"
+: "${CHCREDS_PS1_EXPIRY_WARN_COLOR=red}"
+
 # Optional user hook functions (names of functions, not the code itself). Set
 # CHCREDS_PS1_CRED_COLOR_FUNCTION to a function that takes the credential name and
 # prints a colour to make the credential colour dynamic (e.g. by environment).
@@ -112,6 +120,29 @@ _chcreds_ps1_colorize() {
         "$_chcreds_ps1_open" $'\033[0m' "$_chcreds_ps1_close"
 }
 
+# --- Expiry helpers -----------------------------------------------------------
+
+# Print the seconds until an OS_CRED_EXPIRES_AT timestamp, using GNU or BSD
+# date. Prints nothing if the timestamp can't be parsed.
+_chcreds_ps1_expires_in() {
+    local expires now
+    expires=$(date -u -d "$1" +%s 2>/dev/null || date -u -j -f '%Y-%m-%dT%H:%M:%SZ' "$1" +%s 2>/dev/null) || return
+    now=$(date +%s)
+    printf '%s' $((expires - now))
+}
+
+# Format a number of seconds as 1h05m, 12m or expired.
+_chcreds_ps1_countdown() {
+    local secs="$1"
+    if (( secs <= 0 )); then
+        printf 'expired'
+    elif (( secs >= 3600 )); then
+        printf '%dh%02dm' $((secs / 3600)) $((secs % 3600 / 60))
+    else
+        printf '%dm' $((secs / 60))
+    fi
+}
+
 # --- Main function ------------------------------------------------------------
 
 chcreds_ps1() {
@@ -132,6 +163,19 @@ chcreds_ps1() {
         cred_color=$("$CHCREDS_PS1_CRED_COLOR_FUNCTION" "$cred")
     fi
 
+    # Expiry countdown, which overrides the cred colour when nearly expired.
+    local countdown="" expiry_color="$CHCREDS_PS1_EXPIRY_COLOR" expires_in
+    if [[ "$CHCREDS_PS1_EXPIRY_ENABLE" == "true" && -n "${OS_CRED_EXPIRES_AT:-}" ]]; then
+        expires_in=$(_chcreds_ps1_expires_in "$OS_CRED_EXPIRES_AT")
+        if [[ -n "$expires_in" ]]; then
+            countdown=$(_chcreds_ps1_countdown "$expires_in")
+            if (( expires_in <= CHCREDS_PS1_EXPIRY_WARN )); then
+                cred_color="$CHCREDS_PS1_EXPIRY_WARN_COLOR"
+                expiry_color="$CHCREDS_PS1_EXPIRY_WARN_COLOR"
+            fi
+        fi
+    fi
+
     # Symbol.
     local symbol=""
     if [[ "$CHCREDS_PS1_SYMBOL_ENABLE" == "true" ]]; then
@@ -150,6 +194,10 @@ chcreds_ps1() {
         out+="$CHCREDS_PS1_SEPARATOR"
     fi
     out+=$(_chcreds_ps1_colorize "$cred_color" "$cred_disp")
+    if [[ -n "$countdown" ]]; then
+        out+="$CHCREDS_PS1_SEPARATOR"
+        out+=$(_chcreds_ps1_colorize "$expiry_color" "$countdown")
+    fi
     out+=$(_chcreds_ps1_colorize "$CHCREDS_PS1_SUFFIX_COLOR" "$CHCREDS_PS1_SUFFIX")
 
     printf '%s' "$out"
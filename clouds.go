@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// cloudAuthKeys are the variables that go in a clouds.yaml entry's auth
+// section. Other OS_* variables are set on the entry itself.
+var cloudAuthKeys = map[string]bool{
+	"OS_AUTH_URL":                      true,
+	"OS_TOKEN":                         true,
+	"OS_USERNAME":                      true,
+	"OS_USER_ID":                       true,
+	"OS_PASSWORD":                      true,
+	"OS_USER_DOMAIN_ID":                true,
+	"OS_USER_DOMAIN_NAME":              true,
+	"OS_PROJECT_ID":                    true,
+	"OS_PROJECT_NAME":                  true,
+	"OS_PROJECT_DOMAIN_ID":             true,
+	"OS_PROJECT_DOMAIN_NAME":           true,
+	"OS_DOMAIN_ID":                     true,
+	"OS_DOMAIN_NAME":                   true,
+	"OS_SYSTEM_SCOPE":                  true,
+	"OS_APPLICATION_CREDENTIAL_ID":     true,
+	"OS_APPLICATION_CREDENTIAL_NAME":   true,
+	"OS_APPLICATION_CREDENTIAL_SECRET": true,
+	"OS_IDENTITY_PROVIDER":             true,
+	"OS_PROTOCOL":                      true,
+	"OS_CLIENT_ID":                     true,
+	"OS_CLIENT_SECRET":                 true,
+	"OS_DISCOVERY_ENDPOINT":            true,
+	"OS_ACCESS_TOKEN_ENDPOINT":         true,
+	"OS_ACCESS_TOKEN_TYPE":             true,
+	"OS_OPENID_SCOPE":                  true,
+}
+
+// cloudKeyNames are the clouds.yaml keys for variables that aren't simply
+// the lowercased name without the OS_ prefix
+var cloudKeyNames = map[string]string{
+	"OS_STORAGE_URL": "object_store_endpoint_override",
+}
+
+// cloudSkipKeys only make sense in the environment
+var cloudSkipKeys = map[string]bool{
+	"OS_CRED":               true,
+	"OS_CLOUD":              true,
+	"OS_CLIENT_CONFIG_FILE": true,
+}
+
+// cloudKey returns the clouds.yaml key for an OS_* variable
+func cloudKey(name string) string {
+	if key, ok := cloudKeyNames[name]; ok {
+		return key
+	}
+	return strings.ToLower(strings.TrimPrefix(name, "OS_"))
+}
+
+// cloudEntry converts the variables to a clouds.yaml cloud entry, returning
+// it along with the cloud name taken from OS_CRED
+func cloudEntry(vars []EnvVar) (string, *yaml.Node) {
+	name := ""
+	entry := &yaml.Node{Kind: yaml.MappingNode}
+	auth := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, v := range vars {
+		switch {
+		case v.Key == "OS_CRED":
+			name = v.Value
+		case cloudSkipKeys[v.Key] || strings.HasPrefix(v.Key, "OS_CRED_") || !strings.HasPrefix(v.Key, "OS_"):
+			debugf("Not adding %s to clouds.yaml\n", v.Key)
+		case cloudAuthKeys[v.Key]:
+			// Quote auth values, so a numeric password or ID stays a string
+			setMappingValue(auth, cloudKey(v.Key), &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v.Value})
+		default:
+			setMappingValue(entry, cloudKey(v.Key), &yaml.Node{Kind: yaml.ScalarNode, Value: v.Value})
+		}
+	}
+
+	setMappingValue(entry, "auth", auth)
+	return name, entry
+}
+
+// cloudsYAML returns a clouds.yaml document holding just the one cloud
+func cloudsYAML(name string, entry *yaml.Node) ([]byte, error) {
+	clouds := &yaml.Node{Kind: yaml.MappingNode}
+	setMappingValue(clouds, name, entry)
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	setMappingValue(root, "clouds", clouds)
+	return encodeYAML(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}})
+}
+
+// mergeCloudsFile adds or replaces the cloud in a clouds.yaml file, keeping
+// the other clouds and any comments. The file is created if needed.
+func mergeCloudsFile(path, name string, entry *yaml.Node) error {
+	doc := &yaml.Node{Kind: yaml.DocumentNode}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := yaml.Unmarshal(data, doc); err != nil {
+			return fmt.Errorf("failed to parse: %v", err)
+		}
+	}
+
+	if len(doc.Content) == 0 {
+		doc.Content = []*yaml.Node{{Kind: yaml.MappingNode}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected a mapping at the top level")
+	}
+
+	clouds := mappingValue(root, "clouds")
+	if clouds == nil {
+		clouds = &yaml.Node{Kind: yaml.MappingNode}
+		setMappingValue(root, "clouds", clouds)
+	}
+	if clouds.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected clouds to be a mapping")
+	}
+	setMappingValue(clouds, name, entry)
+
+	out, err := encodeYAML(doc)
+	if err != nil {
+		return err
+	}
+
+	return writePrivateFile(path, out)
+}
+
+// writePrivateFile replaces a file holding credentials, making it readable
+// only by the user. The file is replaced atomically, so a failed write
+// doesn't lose what was there before.
+func writePrivateFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// defaultCloudsFile returns the clouds.yaml used by the os-cloud format when
+// --clouds-file isn't given. It's kept with the token cache rather than in
+// ~/.config/openstack, as the tokens in it expire.
+func defaultCloudsFile() (string, error) {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "clouds.yaml"), nil
+}
+
+func encodeYAML(node *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mappingValue returns the value for a key in a YAML mapping, or nil
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue sets a key in a YAML mapping, replacing any existing value
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 type CredentialFile struct {
@@ -27,6 +28,7 @@ type Credentials struct {
 	UserDomainName              string
 	UserDomainId                string
 	Region                      string
+	Interface                   string
 	TOTPCode                    string
 	TOTPRequired                bool
 	ProjectID                   string
@@ -36,62 +38,30 @@ type Credentials struct {
 	SystemScope                 string
 	ApplicationCredentialID     string
 	ApplicationCredentialSecret string
+	Token                       string
+	AuthType                    string
+	IdentityProvider            string
+	Protocol                    string
+	DiscoveryEndpoint           string
+	AccessTokenEndpoint         string
+	DeviceAuthEndpoint          string
+	AccessTokenType             string
+	ClientID                    string
+	ClientSecret                string
+	OpenIDScope                 string
+	ProjectDomainID             string
+	ProjectDomainName           string
+	CACert                      string
+	Cert                        string
+	Key                         string
+	Insecure                    bool
 	ProjectDiscover             bool
+	RegionDiscover              bool
 	Passthrough                 bool
+	ExportEndpoints             []string
 	RawVars                     []EnvVar
 }
 
-func getPassDir() string {
-	passDir := os.Getenv("PASSWORD_STORE_DIR")
-	if passDir == "" {
-		homeDir, _ := os.UserHomeDir()
-		passDir = filepath.Join(homeDir, ".password-store")
-	}
-	return passDir
-}
-
-func GetPassCredFiles() ([]CredentialFile, error) {
-	passDir := getPassDir()
-
-	var credFiles []CredentialFile
-
-	err := filepath.Walk(passDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-
-		if !info.IsDir() && strings.HasSuffix(info.Name(), ".openrc.gpg") {
-			relPath, err := filepath.Rel(passDir, path)
-			if err != nil {
-				return nil
-			}
-
-			passPath := strings.TrimSuffix(relPath, ".gpg")
-			passPath = filepath.ToSlash(passPath)
-
-			// Create display name without the extension
-			displayName := strings.TrimSuffix(passPath, ".openrc")
-
-			credFiles = append(credFiles, CredentialFile{
-				Path:        passPath,
-				Type:        "openrc",
-				DisplayName: displayName,
-			})
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	sort.Slice(credFiles, func(i, j int) bool {
-		return credFiles[i].DisplayName < credFiles[j].DisplayName
-	})
-	return credFiles, nil
-}
-
 // FindCredentialFile searches for a credential file by path or display name
 func FindCredentialFile(credFiles []CredentialFile, pathOrName string) CredentialFile {
 	// Normalize the input by removing .openrc extension if present
@@ -111,29 +81,78 @@ func FindCredentialFile(credFiles []CredentialFile, pathOrName string) Credentia
 	return CredentialFile{}
 }
 
-func LoadCredentials(credFile CredentialFile) (*Credentials, error) {
-	decryptedText, err := passShow(credFile.Path)
+// Config is the oscreds config file, $XDG_CONFIG_HOME/oscreds/config.yaml
+type Config struct {
+	Store StoreConfig `yaml:"store"`
+}
+
+// StoreConfig chooses and configures the credential store
+type StoreConfig struct {
+	Type string `yaml:"type"`
+	// Dir is the directory of encrypted files for the gpg and age stores. The
+	// gpg store defaults to the password store.
+	Dir string `yaml:"dir"`
+	// Recipients to encrypt new entries to with the gpg and age stores
+	Recipients []string `yaml:"recipients"`
+	// Identity is the age identity file to decrypt with
+	Identity string `yaml:"identity"`
+}
+
+// getConfigFile returns the config file path, which OSCREDS_CONFIG overrides
+func getConfigFile() (string, error) {
+	if path := os.Getenv("OSCREDS_CONFIG"); path != "" {
+		return path, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "oscreds", "config.yaml"), nil
+}
+
+// LoadConfig reads the config file. A missing file gives the defaults.
+func LoadConfig() (*Config, error) {
+	config := &Config{}
+
+	path, err := getConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	debugf("Loaded config from %s\n", path)
+	return config, nil
+}
 
-	creds := &Credentials{}
-	lines := strings.Split(decryptedText, "\n")
+func LoadCredentials(store CredentialStore, credFile CredentialFile) (*Credentials, error) {
+	vars, err := loadOpenrcVars(store, credFile.Path, nil)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if after, ok := strings.CutPrefix(line, "export "); ok {
-			line = after
-		}
+	creds := &Credentials{}
+	for _, v := range vars {
+		key, value := v.Key, v.Value
 
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
+		if secretRefKeys[key] {
+			resolved, err := resolveSecretRef(store, value)
+			if err != nil {
+				return nil, fmt.Errorf("resolving %s: %w", key, err)
+			}
+			if resolved != value {
+				debugf("Resolved %s from %s\n", key, strings.SplitN(value, ":", 2)[0]+":")
+			}
+			value = resolved
 		}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.Trim(strings.TrimSpace(parts[1]), "\"'")
-
 		// Keep the original variables for passthrough mode, excluding the
 		// ones that only control chcreds behaviour
 		if strings.HasPrefix(key, "OS_") && !strings.HasPrefix(key, "OS_CRED_") && key != "OS_TOTP_REQUIRED" {
@@ -153,6 +172,8 @@ func LoadCredentials(credFile CredentialFile) (*Credentials, error) {
 			creds.UserDomainId = value
 		case "OS_REGION_NAME":
 			creds.Region = value
+		case "OS_INTERFACE":
+			creds.Interface = value
 		case "OS_PROJECT_ID":
 			creds.ProjectID = value
 		case "OS_PROJECT_NAME":
@@ -163,16 +184,54 @@ func LoadCredentials(credFile CredentialFile) (*Credentials, error) {
 			creds.DomainName = value
 		case "OS_SYSTEM_SCOPE":
 			creds.SystemScope = value
+		case "OS_CACERT":
+			creds.CACert = value
+		case "OS_CERT":
+			creds.Cert = value
+		case "OS_KEY":
+			creds.Key = value
+		case "OS_INSECURE":
+			creds.Insecure = isTruthy(value)
 		case "OS_TOTP_REQUIRED":
 			creds.TOTPRequired = isTruthy(value)
 		case "OS_CRED_PROJECT_DISCOVER":
 			creds.ProjectDiscover = isTruthy(value)
+		case "OS_CRED_REGION_DISCOVER":
+			creds.RegionDiscover = isTruthy(value)
 		case "OS_CRED_PASSTHROUGH":
 			creds.Passthrough = isTruthy(value)
+		case "OS_CRED_EXPORT_ENDPOINTS":
+			creds.ExportEndpoints = splitList(value)
 		case "OS_APPLICATION_CREDENTIAL_ID":
 			creds.ApplicationCredentialID = value
 		case "OS_APPLICATION_CREDENTIAL_SECRET":
 			creds.ApplicationCredentialSecret = value
+		case "OS_TOKEN":
+			creds.Token = value
+		case "OS_AUTH_TYPE":
+			creds.AuthType = value
+		case "OS_IDENTITY_PROVIDER":
+			creds.IdentityProvider = value
+		case "OS_PROTOCOL":
+			creds.Protocol = value
+		case "OS_DISCOVERY_ENDPOINT":
+			creds.DiscoveryEndpoint = value
+		case "OS_ACCESS_TOKEN_ENDPOINT":
+			creds.AccessTokenEndpoint = value
+		case "OS_DEVICE_AUTHORIZATION_ENDPOINT":
+			creds.DeviceAuthEndpoint = value
+		case "OS_ACCESS_TOKEN_TYPE":
+			creds.AccessTokenType = value
+		case "OS_CLIENT_ID":
+			creds.ClientID = value
+		case "OS_CLIENT_SECRET":
+			creds.ClientSecret = value
+		case "OS_OPENID_SCOPE":
+			creds.OpenIDScope = value
+		case "OS_PROJECT_DOMAIN_ID":
+			creds.ProjectDomainID = value
+		case "OS_PROJECT_DOMAIN_NAME":
+			creds.ProjectDomainName = value
 		}
 	}
 
@@ -184,42 +243,82 @@ func LoadCredentials(credFile CredentialFile) (*Credentials, error) {
 	return creds, nil
 }
 
-func isTruthy(value string) bool {
-	return strings.ToLower(value) == "true" || value == "1"
-}
-
-func passShow(entry string) (string, error) {
-	cmd := exec.Command("pass", "show", entry)
-	cmd.Env = withPasswordStoreDir(os.Environ(), getPassDir())
+// loadOpenrcVars reads and parses an entry, along with the entries listed in
+// its OS_CRED_INCLUDE. Included entries are loaded in order and each one
+// overrides the ones before, with the entry's own variables last. stack holds
+// the entries being loaded, to catch include cycles.
+func loadOpenrcVars(store CredentialStore, entry string, stack []string) ([]EnvVar, error) {
+	if slices.Contains(stack, entry) {
+		return nil, fmt.Errorf("include cycle back to %s", entry)
+	}
 
-	output, err := cmd.CombinedOutput()
+	text, err := store.Read(entry)
+	if err != nil {
+		return nil, err
+	}
+	vars, err := parseOpenrc(text, openrcEnvLookup)
 	if err != nil {
-		msg := strings.TrimSpace(string(output))
-		if msg != "" {
-			msg = ": " + msg
+		return nil, err
+	}
+
+	var includes []string
+	for _, v := range vars {
+		if v.Key == "OS_CRED_INCLUDE" {
+			includes = splitList(v.Value)
 		}
-		return "", fmt.Errorf("pass show %q failed: %w%s", entry, err, msg)
 	}
 
-	return string(output), nil
+	var merged []EnvVar
+	stack = append(stack, entry)
+	for _, include := range includes {
+		debugf("Including %s in %s\n", include, entry)
+		includeVars, err := loadOpenrcVars(store, include, stack)
+		if err != nil {
+			return nil, fmt.Errorf("including %s: %w", include, err)
+		}
+		merged = mergeVars(merged, includeVars)
+	}
+	return mergeVars(merged, vars), nil
 }
 
-func withPasswordStoreDir(env []string, passDir string) []string {
-	const key = "PASSWORD_STORE_DIR="
-	out := make([]string, 0, len(env)+1)
-	found := false
-	for _, item := range env {
-		if strings.HasPrefix(item, key) {
-			out = append(out, key+passDir)
-			found = true
-			continue
+// mergeVars returns base with the variables in override replacing or added
+// to it
+func mergeVars(base, override []EnvVar) []EnvVar {
+	merged := append([]EnvVar(nil), base...)
+	for _, v := range override {
+		i := slices.IndexFunc(merged, func(m EnvVar) bool { return m.Key == v.Key })
+		if i >= 0 {
+			merged[i].Value = v.Value
+		} else {
+			merged = append(merged, v)
 		}
-		out = append(out, item)
 	}
-	if !found {
-		out = append(out, key+passDir)
+	return merged
+}
+
+func isTruthy(value string) bool {
+	return strings.ToLower(value) == "true" || value == "1"
+}
+
+// splitList splits a comma or space separated list, dropping empty items
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// CredentialsFromEnv returns the credentials currently loaded in the
+// environment, for commands that act on an existing token
+func CredentialsFromEnv() *Credentials {
+	return &Credentials{
+		AuthURL:  os.Getenv("OS_AUTH_URL"),
+		Token:    os.Getenv("OS_TOKEN"),
+		Region:   os.Getenv("OS_REGION_NAME"),
+		CACert:   os.Getenv("OS_CACERT"),
+		Cert:     os.Getenv("OS_CERT"),
+		Key:      os.Getenv("OS_KEY"),
+		Insecure: isTruthy(os.Getenv("OS_INSECURE")),
 	}
-	return out
 }
 
 // HasProjectDefined returns true if the credentials have a project already specified
@@ -236,3 +335,35 @@ func (c *Credentials) HasDomainScopeDefined() bool {
 func (c *Credentials) IsApplicationCredential() bool {
 	return c.ApplicationCredentialID != "" && c.ApplicationCredentialSecret != ""
 }
+
+// NeedsPassword returns true if the credentials authenticate with a password
+// the openrc doesn't hold, as in the openrc files Horizon generates
+func (c *Credentials) NeedsPassword() bool {
+	if c.Password != "" || c.Username == "" || c.ApplicationCredentialID != "" || c.IsToken() {
+		return false
+	}
+	return !c.IsOIDC() || c.AuthType == authTypeOIDCPassword
+}
+
+// IsToken returns true if the credentials authenticate with an existing
+// Keystone token
+func (c *Credentials) IsToken() bool {
+	return c.Token != "" || c.AuthType == "token" || c.AuthType == "v3token"
+}
+
+// OpenID Connect auth types, matching the keystoneauth plugin names
+const (
+	authTypeOIDCPassword          = "v3oidcpassword"
+	authTypeOIDCClientCredentials = "v3oidcclientcredentials"
+	authTypeOIDCDeviceAuthz       = "v3oidcdeviceauthz"
+)
+
+// IsOIDC returns true if the credentials authenticate through an OpenID
+// Connect identity provider federated with Keystone
+func (c *Credentials) IsOIDC() bool {
+	switch c.AuthType {
+	case authTypeOIDCPassword, authTypeOIDCClientCredentials, authTypeOIDCDeviceAuthz:
+		return true
+	}
+	return false
+}
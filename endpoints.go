@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// chooseRegion sets the session's region from --region or, when the
+// credential doesn't set one or enables OS_CRED_REGION_DISCOVER, from the
+// regions in the token's catalog
+func chooseRegion(s *Session) {
+	creds := s.Creds
+	var regions []string
+	if s.TokenResponse != nil {
+		regions = s.TokenResponse.Regions()
+	}
+
+	if regionName != "" {
+		if len(regions) > 0 && !slices.Contains(regions, regionName) {
+			fmt.Fprintf(os.Stderr, "Warning: region %s isn't in the catalog (found %s)\n", regionName, strings.Join(regions, ", "))
+		}
+		creds.Region = regionName
+		return
+	}
+	if creds.Region != "" && !creds.RegionDiscover {
+		return
+	}
+
+	switch len(regions) {
+	case 0:
+		debugf("No regions found in the catalog\n")
+		return
+	case 1:
+		debugf("Using the only region in the catalog: %s\n", regions[0])
+		creds.Region = regions[0]
+		return
+	}
+
+	region := SelectRegion(regions, s.CredFile)
+	if region == "" {
+		fmt.Fprintf(os.Stderr, "No region selected\n")
+		os.Exit(1)
+	}
+	creds.Region = region
+}
+
+// defaultInterface is the catalog interface used when OS_INTERFACE isn't set
+const defaultInterface = "public"
+
+// endpointVarNames are the variables clients read for services that don't
+// use the generic OS_<TYPE>_ENDPOINT_OVERRIDE naming
+var endpointVarNames = map[string]string{
+	"object-store": "OS_STORAGE_URL",
+}
+
+// endpointVarName returns the variable to export a service's endpoint as
+func endpointVarName(serviceType string) string {
+	if name, ok := endpointVarNames[serviceType]; ok {
+		return name
+	}
+	name := strings.ToUpper(strings.ReplaceAll(serviceType, "-", "_"))
+	return "OS_" + name + "_ENDPOINT_OVERRIDE"
+}
+
+// Endpoint finds the URL for a service in the token's catalog for the given
+// region and interface. An empty region matches any region.
+func (t *TokenResponse) Endpoint(serviceType, region, iface string) (string, bool) {
+	// Accept the old publicURL style names as well
+	iface = strings.TrimSuffix(iface, "URL")
+
+	for _, service := range t.Token.Catalog {
+		if service.Type != serviceType {
+			continue
+		}
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Interface != iface {
+				continue
+			}
+			if region != "" && endpoint.Region != region {
+				continue
+			}
+			return endpoint.URL, true
+		}
+	}
+	return "", false
+}
+
+// Regions returns the distinct regions in the token's catalog, sorted
+func (t *TokenResponse) Regions() []string {
+	seen := map[string]bool{}
+	var regions []string
+	for _, service := range t.Token.Catalog {
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Region != "" && !seen[endpoint.Region] {
+				seen[endpoint.Region] = true
+				regions = append(regions, endpoint.Region)
+			}
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// endpointVars returns the variables for the services listed in
+// OS_CRED_EXPORT_ENDPOINTS. Each entry is a service type, optionally followed
+// by =NAME to choose the variable it's exported as.
+func endpointVars(creds *Credentials, tokenResponse *TokenResponse) []EnvVar {
+	if len(creds.ExportEndpoints) == 0 {
+		return nil
+	}
+	if tokenResponse == nil || len(tokenResponse.Token.Catalog) == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: the token has no service catalog, not exporting endpoints (try --refresh)\n")
+		return nil
+	}
+
+	iface := creds.Interface
+	if iface == "" {
+		iface = defaultInterface
+	}
+
+	var vars []EnvVar
+	for _, entry := range creds.ExportEndpoints {
+		serviceType, name, ok := strings.Cut(entry, "=")
+		if !ok {
+			name = endpointVarName(serviceType)
+		}
+
+		url, found := tokenResponse.Endpoint(serviceType, creds.Region, iface)
+		if !found {
+			fmt.Fprintf(os.Stderr, "Warning: no %s endpoint for %s found in the catalog", iface, serviceType)
+			if creds.Region != "" {
+				fmt.Fprintf(os.Stderr, " for region %s", creds.Region)
+			}
+			fmt.Fprintf(os.Stderr, "\n")
+			continue
+		}
+
+		debugf("Exporting %s endpoint as %s: %s\n", serviceType, name, url)
+		vars = append(vars, EnvVar{Key: name, Value: url})
+	}
+	return vars
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// runExec resolves a credential as chcreds would and runs a command with the
+// variables in its environment, leaving the calling shell untouched
+func runExec(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	addAuthModeFlags(fs)
+	addAuthFlags(fs)
+	fs.Usage = func() {
+		printUsage(fs, "exec [options] [credential] -- command [args...]")
+	}
+
+	// Split on the first -- ourselves, as the flag package would also
+	// consume it when no credential is given
+	sep := -1
+	for i, arg := range args {
+		if arg == "--" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || sep == len(args)-1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	command := args[sep+1:]
+	fs.Parse(args[:sep])
+
+	if err := setAuthMode(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	DebugMode = debugMode
+
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(127)
+	}
+
+	vars, _ := resolveVars(fs.Args())
+
+	cmd := exec.Command(path, command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = execEnv(os.Environ(), vars)
+
+	debugf("Running %s with %d OS_* variables\n", path, len(vars))
+	os.Exit(runCommand(cmd))
+}
+
+// execEnv returns the environment with any inherited OS_* variables replaced
+// by the resolved ones, so settings from another cloud can't leak through
+func execEnv(environ []string, vars []EnvVar) []string {
+	var env []string
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, "OS_") {
+			env = append(env, kv)
+		}
+	}
+	for _, v := range vars {
+		env = append(env, v.Key+"="+v.Value)
+	}
+	return env
+}
+
+// runCommand runs the command to completion and returns its exit status,
+// passing on interrupts rather than exiting before the command does
+func runCommand(cmd *exec.Cmd) int {
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running %s: %v\n", cmd.Path, err)
+		return 126
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// Report death by signal the way shells do
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error running %s: %v\n", cmd.Path, err)
+		return 1
+	}
+	return 0
+}
@@ -2,7 +2,11 @@ module oscreds
 
 go 1.24.4
 
-require github.com/junegunn/fzf v0.65.1
+require (
+	github.com/junegunn/fzf v0.65.1
+	golang.org/x/term v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/charlievieth/fastwalk v1.0.12 // indirect
@@ -14,6 +18,5 @@ require (
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/sys v0.30.0 // indirect
-	golang.org/x/term v0.29.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
 )
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Keystone HTTP timeouts. The response timeout covers the wait for response
+// headers, not reading the body.
+const (
+	keystoneConnectTimeout  = 10 * time.Second
+	keystoneResponseTimeout = 30 * time.Second
+)
+
+// KeystoneClient makes requests to the Keystone identity API, sharing a
+// single HTTP client configured from the credential's TLS settings
+type KeystoneClient struct {
+	authURL    string
+	httpClient *http.Client
+}
+
+// NewKeystoneClient returns a client for the credential's auth URL, honouring
+// OS_CACERT, OS_CERT/OS_KEY and OS_INSECURE
+func NewKeystoneClient(creds *Credentials) (*KeystoneClient, error) {
+	tlsConfig, err := newTLSConfig(creds)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   keystoneConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   keystoneConnectTimeout,
+		ResponseHeaderTimeout: keystoneResponseTimeout,
+		ForceAttemptHTTP2:     true,
+	}
+
+	return &KeystoneClient{
+		authURL:    creds.AuthURL,
+		httpClient: &http.Client{Transport: transport},
+	}, nil
+}
+
+// newTLSConfig builds the TLS settings from the credential, or returns nil
+// to use Go's defaults when none are set
+func newTLSConfig(creds *Credentials) (*tls.Config, error) {
+	if creds.CACert == "" && creds.Cert == "" && !creds.Insecure {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if creds.CACert != "" {
+		debugf("Using CA bundle: %s\n", creds.CACert)
+		pem, err := os.ReadFile(creds.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OS_CACERT: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in OS_CACERT file %s", creds.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if creds.Cert != "" {
+		// OS_KEY may be omitted when the key is in the same file as the
+		// certificate
+		keyFile := creds.Key
+		if keyFile == "" {
+			keyFile = creds.Cert
+		}
+		debugf("Using client certificate: %s (key: %s)\n", creds.Cert, keyFile)
+		cert, err := tls.LoadX509KeyPair(creds.Cert, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if creds.Insecure {
+		debugf("OS_INSECURE set - not verifying Keystone's certificate\n")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	return tlsConfig, nil
+}
+
+// maxReceiptRounds limits how many times a request is resubmitted with an
+// auth receipt before giving up
+const maxReceiptRounds = 3
+
+// requestToken posts an auth request to /v3/auth/tokens and returns the
+// issued token along with the parsed response. The description is used to
+// label debug output and errors. If Keystone answers with an auth receipt
+// because the user's MFA rules require further methods, they are supplied
+// from creds, prompting where needed, and the request is resubmitted.
+func (k *KeystoneClient) requestToken(description string, creds *Credentials, authData map[string]interface{}, nocatalog bool) (string, *TokenResponse, error) {
+	receiptID := ""
+	for round := 0; ; round++ {
+		token, tokenResponse, receipt, err := k.postToken(description, authData, nocatalog, receiptID)
+		if err != nil || receipt == nil {
+			return token, tokenResponse, err
+		}
+
+		if round >= maxReceiptRounds {
+			return "", nil, fmt.Errorf("%s failed: Keystone still requires further auth methods after %d attempts", description, round+1)
+		}
+
+		identity, err := receiptIdentity(creds, receipt)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s failed: %w", description, err)
+		}
+
+		// Resubmit the same scope with only the missing methods, as Keystone
+		// takes the ones already satisfied from the receipt
+		auth := map[string]interface{}{}
+		for key, value := range authData["auth"].(map[string]interface{}) {
+			auth[key] = value
+		}
+		auth["identity"] = identity
+		authData = map[string]interface{}{"auth": auth}
+		receiptID = receipt.ID
+	}
+}
+
+// postToken makes a single token request. An auth receipt is returned,
+// rather than an error, when Keystone requires further auth methods.
+func (k *KeystoneClient) postToken(description string, authData map[string]interface{}, nocatalog bool, receiptID string) (string, *TokenResponse, *authReceipt, error) {
+	jsonData, err := json.Marshal(authData)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	path := "/v3/auth/tokens"
+	if nocatalog {
+		path += "?nocatalog"
+	}
+
+	url := getUrlPath(k.authURL, path)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonData))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if receiptID != "" {
+		req.Header.Set(authReceiptHeader, receiptID)
+	}
+
+	debugf("Making %s request to: %s\n", description, url)
+	debugf("Request body: %s\n", string(jsonData))
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		debugf("HTTP request failed: %v\n", err)
+		return "", nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	debugf("HTTP response status: %s (%d)\n", resp.Status, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get(authReceiptHeader) != "" {
+		var receipt authReceipt
+		if err := json.Unmarshal(body, &receipt); err != nil {
+			return "", nil, nil, fmt.Errorf("failed to parse auth receipt: %v", err)
+		}
+		receipt.ID = resp.Header.Get(authReceiptHeader)
+		debugf("Received auth receipt - satisfied methods: %v, required: %v\n", receipt.Receipt.Methods, receipt.RequiredAuthMethods)
+		return "", nil, &receipt, nil
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		debugf("%s failed with body: %s\n", description, string(body))
+		return "", nil, nil, &KeystoneError{Message: description + " failed", Status: resp.Status, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	token := resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		debugf("No X-Subject-Token header received\n")
+		return "", nil, nil, fmt.Errorf("no token received")
+	}
+
+	debugf("Successfully obtained token (length: %d)\n", len(token))
+
+	var tokenResponse TokenResponse
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		debugf("Failed to parse token response: %v\n", err)
+		return "", nil, nil, fmt.Errorf("failed to parse token response: %v", err)
+	}
+
+	return token, &tokenResponse, nil, nil
+}
+
+// get makes an authenticated GET request against the identity API, with any
+// extra headers given, returning the body of a 200 response
+func (k *KeystoneClient) get(path, token string, headers map[string]string) ([]byte, error) {
+	url := getUrlPath(k.authURL, path)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	debugf("Making GET request to: %s\n", url)
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &KeystoneError{Message: "request to " + path + " failed", Status: resp.Status, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	return body, nil
+}
+
+// post makes an authenticated POST request with a JSON body against the
+// identity API, returning the body of a 201 response
+func (k *KeystoneClient) post(path, token string, data interface{}) ([]byte, error) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	url := getUrlPath(k.authURL, path)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Auth-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+
+	debugf("Making POST request to: %s\n", url)
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, &KeystoneError{Message: "request to " + path + " failed", Status: resp.Status, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	return body, nil
+}
+
+// delete makes an authenticated DELETE request against the identity API,
+// with any extra headers given, expecting a 204 response
+func (k *KeystoneClient) delete(path, token string, headers map[string]string) error {
+	url := getUrlPath(k.authURL, path)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("X-Auth-Token", token)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	debugf("Making DELETE request to: %s\n", url)
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusNoContent {
+		return &KeystoneError{Message: "request to " + path + " failed", Status: resp.Status, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	return nil
+}
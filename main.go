@@ -1,10 +1,11 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
-	"strings"
 )
 
 var debugMode bool
@@ -13,6 +14,25 @@ var shellType string
 
 var projectName string
 
+// regionName is set by --region, choosing a region from the token's catalog
+var regionName string
+
+// noCache skips token cache lookups, forcing a fresh token from Keystone
+var noCache bool
+
+// refreshProjects skips the project list cache during project discovery
+var refreshProjects bool
+
+// tokenStdin reads a Keystone token to authenticate with from stdin
+var tokenStdin bool
+
+// tokenAuth and passwordAuth are set by the --token and --password flags
+var tokenAuth, passwordAuth bool
+
+// exportMetadata adds the OS_CRED_* token details, for prompts, with
+// --metadata or OSCREDS_METADATA=true
+var exportMetadata bool
+
 // authMode selects which auth variables are exported
 const (
 	authModeToken    = "token"
@@ -34,9 +54,13 @@ func debugf(format string, args ...interface{}) {
 // usage prints flags with a double-dash prefix, which the flag package
 // accepts but does not show in its default output
 func usage() {
-	out := flag.CommandLine.Output()
-	fmt.Fprintf(out, "Usage: %s [options] [credential]\n\nOptions:\n", os.Args[0])
-	flag.VisitAll(func(f *flag.Flag) {
+	printUsage(flag.CommandLine, "[options] [credential]")
+}
+
+func printUsage(fs *flag.FlagSet, synopsis string) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: %s %s\n\nOptions:\n", os.Args[0], synopsis)
+	fs.VisitAll(func(f *flag.Flag) {
 		name, usageText := flag.UnquoteUsage(f)
 		if name != "" {
 			name = " " + name
@@ -48,46 +72,187 @@ func usage() {
 	})
 }
 
+// addAuthFlags registers the flags that control how a credential is resolved
+// to a token, shared by the subcommands that authenticate
+func addAuthFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&debugMode, "debug", false, "Enable debug output")
+	fs.StringVar(&projectName, "project", "", "Project name to scope to (skips interactive selection)")
+	fs.StringVar(&regionName, "region", "", "Region to use (skips interactive selection)")
+	fs.BoolVar(&noCache, "no-cache", false, "Ignore cached tokens and request a fresh one from Keystone")
+	fs.BoolVar(&noCache, "refresh", false, "Alias for --no-cache")
+	fs.BoolVar(&refreshProjects, "refresh-projects", false, "Ignore the cached project list and fetch it from Keystone")
+	fs.BoolVar(&tokenStdin, "token-stdin", false, "Authenticate with a Keystone token read from stdin instead of the credential's identity")
+}
+
 func main() {
-	debug := flag.Bool("debug", false, "Enable debug output")
-	flag.StringVar(&shellType, "shell", "bash", "Shell type for output format (bash or fish)")
-	flag.StringVar(&projectName, "project", "", "Project name to scope to (skips interactive selection)")
-	tokenAuth := flag.Bool("token", false, "Export token auth variables (OS_AUTH_TYPE=token, the default)")
-	passwordAuth := flag.Bool("password", false, "Export password auth variables (OS_AUTH_TYPE=password) instead of a token")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "appcred":
+			runAppCred(os.Args[2:])
+			return
+		case "revoke":
+			runRevoke(os.Args[2:])
+			return
+		case "status":
+			runStatus(os.Args[2:])
+			return
+		case "unset":
+			runUnset(os.Args[2:])
+			return
+		case "exec":
+			runExec(os.Args[2:])
+			return
+		case "list":
+			runList()
+			return
+		}
+	}
+
+	flag.StringVar(&shellType, "shell", "bash", "Shell type for output format ("+shellNames()+")")
+	flag.StringVar(&outputFormat, "format", formatShell, "Output format: shell, json, clouds-yaml (a clouds.yaml cloud entry), os-cloud (OS_CLOUD for an entry saved to --clouds-file), env (docker --env-file), systemd (EnvironmentFile) or dotenv")
+	flag.StringVar(&cloudsFile, "clouds-file", "", "clouds.yaml file to save the cloud entry to for --format clouds-yaml or os-cloud")
+	flag.StringVar(&outputFile, "output", "", "Write the output to a file, readable only by you, instead of stdout")
+	addAuthModeFlags(flag.CommandLine)
+	addAuthFlags(flag.CommandLine)
 	flag.Usage = usage
 	flag.Parse()
 
-	if shellType != "bash" && shellType != "fish" {
-		fmt.Fprintf(os.Stderr, "Error: unsupported shell type %q (use bash or fish)\n", shellType)
+	if err := validateOutputFormat(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-
-	if *tokenAuth && *passwordAuth {
-		fmt.Fprintf(os.Stderr, "Error: --token and --password are mutually exclusive\n")
+	if err := setAuthMode(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
-	if *passwordAuth {
+
+	DebugMode = debugMode
+
+	vars, session := resolveVars(flag.Args())
+	outputVars(vars, session)
+}
+
+// addAuthModeFlags registers --token, --password and --metadata, which
+// choose the variables that are exported
+func addAuthModeFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&tokenAuth, "token", false, "Export token auth variables (OS_AUTH_TYPE=token, the default)")
+	fs.BoolVar(&passwordAuth, "password", false, "Export password auth variables (OS_AUTH_TYPE=password) instead of a token")
+	fs.BoolVar(&exportMetadata, "metadata", false, "Export the token's expiry, user, roles and scope as OS_CRED_* variables (or set OSCREDS_METADATA=true)")
+}
+
+// setAuthMode sets authMode from the parsed --token and --password flags
+func setAuthMode() error {
+	if tokenAuth && passwordAuth {
+		return fmt.Errorf("--token and --password are mutually exclusive")
+	}
+	if passwordAuth {
 		authMode = authModePassword
 	}
+	if isTruthy(os.Getenv("OSCREDS_METADATA")) {
+		exportMetadata = true
+	}
+	return nil
+}
+
+// resolveVars loads the credential named by the first argument, or selected
+// by the user, and resolves it to the variables to export. The session is
+// nil in passthrough mode, where no token is fetched.
+func resolveVars(args []string) ([]EnvVar, *Session) {
+	_, credFile, creds := loadSelectedCredentials(args)
+
+	if authMode == authModePassword {
+		if creds.IsApplicationCredential() {
+			fmt.Fprintf(os.Stderr, "Error: --password cannot be used with application credentials\n")
+			os.Exit(1)
+		}
+		if creds.IsOIDC() {
+			fmt.Fprintf(os.Stderr, "Error: --password cannot be used with OpenID Connect credentials\n")
+			os.Exit(1)
+		}
+		if creds.IsToken() {
+			fmt.Fprintf(os.Stderr, "Error: --password cannot be used with token credentials\n")
+			os.Exit(1)
+		}
+		if creds.Passthrough {
+			debugf("Passthrough mode - --password flag has no effect\n")
+		}
+		if creds.TOTPRequired {
+			fmt.Fprintf(os.Stderr, "Warning: TOTP is required for this credential; the exported password auth may not work without a fresh passcode\n")
+		}
+	}
+
+	// Password mode exports the password, and may not need it to authenticate
+	// with a cached token, so ask for it up front
+	if authMode == authModePassword || creds.Passthrough {
+		if err := ensurePassword(creds); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// Passthrough mode - output the credential file variables as-is without
+	// fetching a token, so clients authenticate themselves
+	if creds.Passthrough {
+		debugf("Passthrough mode - outputting credential variables directly\n")
+		if regionName != "" {
+			debugf("Passthrough mode - --region flag has no effect\n")
+		}
+		return passthroughVars(credFile, creds), nil
+	}
+
+	session := authenticate(credFile, creds)
+	chooseRegion(session)
+	vars := append(sessionVars(session), endpointVars(session.Creds, session.TokenResponse)...)
+	vars = append(vars, settingVars(session.Creds, vars)...)
+	if exportMetadata {
+		vars = append(vars, metadataVars(session)...)
+	}
+	return vars, session
+}
+
+// runList prints the credentials in the store, one per line. It isn't in the
+// usage, as it's only there for the shell completions.
+func runList() {
+	store, err := OpenCredentialStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening credential store: %v\n", err)
+		os.Exit(1)
+	}
+
+	credFiles, err := store.List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting credential files: %v\n", err)
+		os.Exit(1)
+	}
+	for _, cf := range credFiles {
+		fmt.Println(cf.DisplayName)
+	}
+}
 
-	debugMode = *debug
-	DebugMode = *debug
+// loadSelectedCredentials finds the credential named by the first argument,
+// or lets the user select one, and loads it from the credential store
+func loadSelectedCredentials(args []string) (CredentialStore, CredentialFile, *Credentials) {
+	store, err := OpenCredentialStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening credential store: %v\n", err)
+		os.Exit(1)
+	}
 
-	credFiles, err := GetPassCredFiles()
+	credFiles, err := store.List()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error getting credential files: %v\n", err)
 		os.Exit(1)
 	}
 
 	if len(credFiles) == 0 {
-		fmt.Fprintf(os.Stderr, "No .openrc files found in pass\n")
+		fmt.Fprintf(os.Stderr, "No .openrc files found in %s\n", store.Name())
 		os.Exit(1)
 	}
 
 	var credFile CredentialFile
 	// Check if a credential path was provided as a positional argument
-	if flag.NArg() > 0 {
-		credPath := flag.Arg(0)
+	if len(args) > 0 {
+		credPath := args[0]
 		credFile = FindCredentialFile(credFiles, credPath)
 		if credFile.Path == "" {
 			fmt.Fprintf(os.Stderr, "Credential file not found: %s\n", credPath)
@@ -104,13 +269,36 @@ func main() {
 
 	// Load credentials from openrc files
 	debugf("Loading credentials from %s (type: %s)\n", credFile.Path, credFile.Type)
-	creds, err := LoadCredentials(credFile)
+	creds, err := LoadCredentials(store, credFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading credentials from %s: %v\n", credFile.Path, err)
 		os.Exit(1)
 	}
+
+	// A token from stdin replaces the credential's own identity, keeping the
+	// cloud settings and scope from the openrc
+	if tokenStdin {
+		token, err := ReadTokenFromStdin()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading token from stdin: %v\n", err)
+			os.Exit(1)
+		}
+		creds.Token = token
+		creds.ApplicationCredentialID = ""
+		creds.ApplicationCredentialSecret = ""
+		creds.AuthType = "v3token"
+	}
+	if creds.IsToken() && creds.Token == "" {
+		fmt.Fprintf(os.Stderr, "Error: OS_AUTH_TYPE=%s requires OS_TOKEN or --token-stdin\n", creds.AuthType)
+		os.Exit(1)
+	}
+
 	if creds.IsApplicationCredential() {
 		debugf("Loaded application credentials - ID: %s, AuthURL: %s\n", creds.ApplicationCredentialID, creds.AuthURL)
+	} else if creds.IsToken() {
+		debugf("Loaded token credentials - AuthURL: %s\n", creds.AuthURL)
+	} else if creds.IsOIDC() {
+		debugf("Loaded OpenID Connect credentials - AuthType: %s, IdP: %s, AuthURL: %s\n", creds.AuthType, creds.IdentityProvider, creds.AuthURL)
 	} else {
 		debugf("Loaded credentials - Username: %s, AuthURL: %s, TOTPRequired: %v\n", creds.Username, creds.AuthURL, creds.TOTPRequired)
 	}
@@ -124,48 +312,29 @@ func main() {
 		debugf("SystemScope defined: %s\n", creds.SystemScope)
 	}
 
-	if authMode == authModePassword {
-		if creds.IsApplicationCredential() {
-			fmt.Fprintf(os.Stderr, "Error: --password cannot be used with application credentials\n")
-			os.Exit(1)
-		}
-		if creds.Passthrough {
-			debugf("Passthrough mode - --password flag has no effect\n")
-		}
-		if creds.TOTPRequired {
-			fmt.Fprintf(os.Stderr, "Warning: TOTP is required for this credential; the exported password auth may not work without a fresh passcode\n")
-		}
-	}
+	return store, credFile, creds
+}
 
-	// Passthrough mode - output the credential file variables as-is without
-	// fetching a token, so clients authenticate themselves
-	if creds.Passthrough {
-		debugf("Passthrough mode - outputting credential variables directly\n")
-		outputPassthroughVars(credFile, creds)
-		return
+// authenticate resolves the credential to a scoped token, prompting for a
+// project when discovery is enabled. Errors are fatal.
+func authenticate(credFile CredentialFile, creds *Credentials) *Session {
+	client, err := NewKeystoneClient(creds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring Keystone client: %v\n", err)
+		os.Exit(1)
 	}
 
-	// Check if TOTP is required and prompt if needed (not applicable for application credentials)
-	if !creds.IsApplicationCredential() && creds.TOTPRequired {
-		debugf("TOTP required, prompting user\n")
-		totpCode, err := PromptForTOTP()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading TOTP code: %v\n", err)
-			os.Exit(1)
-		}
-		creds.TOTPCode = totpCode
-		debugf("TOTP code entered (length: %d)\n", len(totpCode))
-	} else if creds.IsApplicationCredential() {
-		debugf("Application credentials - TOTP not applicable\n")
-	} else {
-		debugf("TOTP not required\n")
+	session := &Session{
+		CredFile: credFile,
+		Creds:    creds,
+		Client:   client,
 	}
 
 	// If using application credentials, get pre-scoped token directly
 	if creds.IsApplicationCredential() {
 		debugf("Application credentials detected - getting pre-scoped token\n")
 
-		token, tokenResponse, err := GetApplicationCredentialToken(creds)
+		token, tokenResponse, err := client.GetApplicationCredentialToken(creds)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error getting application credential token: %v\n", err)
 			os.Exit(1)
@@ -176,23 +345,21 @@ func main() {
 			ID:   tokenResponse.Token.Project.ID,
 			Name: tokenResponse.Token.Project.Name,
 		}
-		outputEnvironmentVars(credFile, selectedProject, token, creds)
-		return
+		return session.scoped(scopeProject, selectedProject, token, tokenResponse)
 	}
 
-	// If system scope is set, get unscoped token only
+	// If system scope is set, rescope an unscoped token to the system
 	if creds.SystemScope != "" {
-		debugf("System scope defined - getting unscoped token only\n")
+		debugf("System scope defined - getting system scoped token\n")
 
-		token, err := GetUnscopedToken(creds)
+		token, tokenResponse, err := client.RescopeToken(creds, "", systemScope(creds))
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error getting unscoped token: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Error getting system scoped token: %v\n", err)
 			os.Exit(1)
 		}
 
-		debugf("Successfully got unscoped token for system scope\n")
-		outputSystemScopeVars(credFile, token, creds)
-		return
+		debugf("Successfully got system scoped token\n")
+		return session.scoped(scopeSystem, nil, token, tokenResponse)
 	}
 
 	if projectName != "" {
@@ -203,7 +370,7 @@ func main() {
 		var err error
 
 		var tokenResponse *TokenResponse
-		scopedToken, tokenResponse, err = GetScopedTokenByProjectName(creds, projectName)
+		scopedToken, tokenResponse, err = client.GetScopedTokenByProjectName(creds, projectName)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error getting scoped token for project %q: %v\n", projectName, err)
 			os.Exit(1)
@@ -213,10 +380,9 @@ func main() {
 			Name: tokenResponse.Token.Project.Name,
 		}
 
-		credFile.DisplayName = credFile.DisplayName + "/" + selectedProject.Name
+		session.CredFile.DisplayName = credFile.DisplayName + "/" + selectedProject.Name
 		debugf("Successfully got scoped token for project: %s\n", selectedProject.Name)
-		outputEnvironmentVars(credFile, selectedProject, scopedToken, creds)
-		return
+		return session.scoped(scopeProject, selectedProject, scopedToken, tokenResponse)
 	}
 
 	if creds.HasProjectDefined() {
@@ -224,16 +390,16 @@ func main() {
 
 		var scopedToken string
 		var selectedProject *Project
+		var tokenResponse *TokenResponse
 		var err error
 
 		if creds.ProjectID != "" {
 			debugf("Using ProjectID: %s\n", creds.ProjectID)
-			scopedToken, err = GetScopedToken(creds, creds.ProjectID)
+			scopedToken, tokenResponse, err = client.GetScopedToken(creds, creds.ProjectID)
 			selectedProject = &Project{ID: creds.ProjectID, Name: creds.ProjectName}
 		} else {
 			debugf("Using ProjectName: %s\n", creds.ProjectName)
-			var tokenResponse *TokenResponse
-			scopedToken, tokenResponse, err = GetScopedTokenByProjectName(creds, creds.ProjectName)
+			scopedToken, tokenResponse, err = client.GetScopedTokenByProjectName(creds, creds.ProjectName)
 			if err == nil {
 				selectedProject = &Project{
 					ID:   tokenResponse.Token.Project.ID,
@@ -248,25 +414,23 @@ func main() {
 		}
 
 		debugf("Successfully got scoped token for project: %s\n", selectedProject.Name)
-		outputEnvironmentVars(credFile, selectedProject, scopedToken, creds)
-		return
+		return session.scoped(scopeProject, selectedProject, scopedToken, tokenResponse)
 	}
 
 	// Project discovery must be explicitly enabled, otherwise fall back to
 	// domain scope if defined
 	if !creds.ProjectDiscover {
 		if creds.HasDomainScopeDefined() {
-			debugf("Domain scope defined - getting unscoped token only\n")
+			debugf("Domain scope defined - getting domain scoped token\n")
 
-			token, err := GetUnscopedToken(creds)
+			token, tokenResponse, err := client.RescopeToken(creds, "", domainScope(creds))
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error getting unscoped token: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Error getting domain scoped token: %v\n", err)
 				os.Exit(1)
 			}
 
-			debugf("Successfully got unscoped token for domain scope\n")
-			outputDomainScopeVars(credFile, token, creds)
-			return
+			debugf("Successfully got domain scoped token\n")
+			return session.scoped(scopeDomain, nil, token, tokenResponse)
 		}
 		fmt.Fprintf(os.Stderr, "No scope defined in credentials. Set OS_PROJECT_NAME or OS_PROJECT_ID,\n"+
 			"OS_DOMAIN_NAME or OS_DOMAIN_ID for domain scope, or\n"+
@@ -277,27 +441,48 @@ func main() {
 	debugf("Project discovery enabled, listing projects for user selection\n")
 
 	var projectsList []Project
+	var token string
 
-	debugf("Getting unscoped token to list projects\n")
-	token, err := GetUnscopedToken(creds)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting unscoped token: %v\n", err)
-		os.Exit(1)
+	cacheUser, cacheUserDomain := getCacheUser(creds)
+	projectsCached := false
+	if !refreshProjects {
+		projectsList, projectsCached = LoadCachedProjects(creds.AuthURL, cacheUser, cacheUserDomain)
 	}
 
-	debugf("Got unscoped token, listing projects\n")
-	projectsList, err = ListProjects(creds.AuthURL, token)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error listing projects: %v\n", err)
-		os.Exit(1)
+	if projectsCached {
+		debugf("Loaded %d projects from cache\n", len(projectsList))
+	} else {
+		debugf("Getting unscoped token to list projects\n")
+		token, err = client.GetUnscopedToken(creds)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting unscoped token: %v\n", err)
+			os.Exit(1)
+		}
+
+		debugf("Got unscoped token, listing projects\n")
+		projectsList, err = client.ListProjects(token)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error listing projects: %v\n", err)
+			os.Exit(1)
+		}
+		debugf("Found %d projects\n", len(projectsList))
+
+		if len(projectsList) > 0 {
+			if err := SaveProjectsToCache(creds.AuthURL, cacheUser, cacheUserDomain, projectsList); err != nil {
+				debugf("Failed to cache project list: %v\n", err)
+			}
+		}
 	}
-	debugf("Found %d projects\n", len(projectsList))
 
 	if len(projectsList) == 0 {
 		if creds.HasDomainScopeDefined() {
 			debugf("No projects found but domain scope defined - using domain scope\n")
-			outputDomainScopeVars(credFile, token, creds)
-			return
+			domainToken, tokenResponse, err := client.RescopeToken(creds, token, domainScope(creds))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error getting domain scoped token: %v\n", err)
+				os.Exit(1)
+			}
+			return session.scoped(scopeDomain, nil, domainToken, tokenResponse)
 		}
 		fmt.Fprintf(os.Stderr, "No projects found\n")
 		os.Exit(1)
@@ -324,100 +509,61 @@ func main() {
 
 	if selectedProject.ID == domainScopeID {
 		debugf("Domain scope selected\n")
-		outputDomainScopeVars(credFile, token, creds)
-		return
+		domainToken, tokenResponse, err := client.RescopeToken(creds, token, domainScope(creds))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting domain scoped token: %v\n", err)
+			os.Exit(1)
+		}
+		return session.scoped(scopeDomain, nil, domainToken, tokenResponse)
 	}
 
-	credFile.DisplayName = credFile.DisplayName + "/" + selectedProject.Name
+	session.CredFile.DisplayName = credFile.DisplayName + "/" + selectedProject.Name
 
-	scopedToken, err := GetScopedToken(creds, selectedProject.ID)
+	// Rescope the unscoped token rather than replaying the password and TOTP
+	// code. If the project list came from the cache, this only authenticates
+	// if there is no cached token for the project.
+	scopedToken, tokenResponse, err := client.RescopeToken(creds, token, projectIDScope(selectedProject.ID))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error getting scoped token: %v\n", err)
+		// The project may have been deleted or our access removed since the
+		// list was cached, so drop it to fetch a fresh one next time. A
+		// failure to authenticate first, such as a mistyped password, says
+		// nothing about the list.
+		var rescopeErr *RescopeError
+		if projectsCached && errors.As(err, &rescopeErr) && IsKeystoneStatus(err, http.StatusUnauthorized, http.StatusNotFound) {
+			if err := ClearCache(creds.AuthURL, cacheUser, cacheUserDomain); err != nil {
+				debugf("Failed to clear project cache: %v\n", err)
+			}
+			fmt.Fprintf(os.Stderr, "The cached project list may be out of date and has been cleared, please try again\n")
+		}
 		os.Exit(1)
 	}
 
-	outputEnvironmentVars(credFile, selectedProject, scopedToken, creds)
-}
-
-func fishEscape(s string) string {
-	s = strings.ReplaceAll(s, `\`, `\\`)
-	s = strings.ReplaceAll(s, `'`, `\'`)
-	return "'" + s + "'"
-}
-
-func bashEscape(s string) string {
-	return "'" + strings.ReplaceAll(s, `'`, `'\''`) + "'"
-}
-
-func outputVar(name string, value string) {
-	if shellType == "fish" {
-		fmt.Printf("set -gx %s %s\n", name, fishEscape(value))
-	} else {
-		fmt.Printf("export %s=%s\n", name, bashEscape(value))
-	}
-}
-
-func outputPassthroughVars(credFile CredentialFile, creds *Credentials) {
-	outputVar("OS_CRED", credFile.DisplayName)
-	for _, v := range creds.RawVars {
-		outputVar(v.Key, v.Value)
-	}
-}
-
-// outputAuthVars exports either the fetched token or, in password mode, the
-// username/password identity so clients authenticate themselves
-func outputAuthVars(token string, creds *Credentials) {
-	if authMode == authModePassword {
-		outputVar("OS_AUTH_TYPE", authModePassword)
-		outputVar("OS_USERNAME", creds.Username)
-		outputVar("OS_PASSWORD", creds.Password)
-		if creds.UserDomainId != "" {
-			outputVar("OS_USER_DOMAIN_ID", creds.UserDomainId)
-		} else {
-			outputVar("OS_USER_DOMAIN_NAME", creds.UserDomainName)
-		}
-		return
-	}
-	outputVar("OS_TOKEN", token)
-	outputVar("OS_AUTH_TYPE", authModeToken)
+	return session.scoped(scopeProject, selectedProject, scopedToken, tokenResponse)
 }
 
-func outputEnvironmentVars(credFile CredentialFile, project *Project, token string, creds *Credentials) {
-	outputVar("OS_CRED", credFile.DisplayName)
-	outputVar("OS_IDENTITY_API_VERSION", "3")
-	outputVar("OS_AUTH_URL", creds.AuthURL)
-	outputVar("OS_PROJECT_ID", project.ID)
-	if authMode == authModePassword && project.Name != "" {
-		outputVar("OS_PROJECT_NAME", project.Name)
-	}
-	outputAuthVars(token, creds)
-	if creds.Region != "" {
-		outputVar("OS_REGION_NAME", creds.Region)
-	}
-}
+// Scope types of an authenticated session
+const (
+	scopeProject = "project"
+	scopeDomain  = "domain"
+	scopeSystem  = "system"
+)
 
-func outputDomainScopeVars(credFile CredentialFile, token string, creds *Credentials) {
-	outputVar("OS_CRED", credFile.DisplayName+"/domain")
-	outputVar("OS_IDENTITY_API_VERSION", "3")
-	outputVar("OS_AUTH_URL", creds.AuthURL)
-	if creds.DomainID != "" {
-		outputVar("OS_DOMAIN_ID", creds.DomainID)
-	} else {
-		outputVar("OS_DOMAIN_NAME", creds.DomainName)
-	}
-	outputAuthVars(token, creds)
-	if creds.Region != "" {
-		outputVar("OS_REGION_NAME", creds.Region)
-	}
+// Session is a credential resolved to a scoped token
+type Session struct {
+	CredFile      CredentialFile
+	Creds         *Credentials
+	Client        *KeystoneClient
+	Scope         string
+	Project       *Project
+	Token         string
+	TokenResponse *TokenResponse
 }
 
-func outputSystemScopeVars(credFile CredentialFile, token string, creds *Credentials) {
-	outputVar("OS_CRED", credFile.DisplayName+"/system")
-	outputVar("OS_IDENTITY_API_VERSION", "3")
-	outputVar("OS_AUTH_URL", creds.AuthURL)
-	outputVar("OS_SYSTEM_SCOPE", creds.SystemScope)
-	outputAuthVars(token, creds)
-	if creds.Region != "" {
-		outputVar("OS_REGION_NAME", creds.Region)
-	}
+func (s *Session) scoped(scope string, project *Project, token string, tokenResponse *TokenResponse) *Session {
+	s.Scope = scope
+	s.Project = project
+	s.Token = token
+	s.TokenResponse = tokenResponse
+	return s
 }
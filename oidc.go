@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	grantTypePassword          = "password"
+	grantTypeClientCredentials = "client_credentials"
+	grantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// oidcDiscovery holds the parts of the identity provider's
+// .well-known/openid-configuration document that we use
+type oidcDiscovery struct {
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type oidcDeviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// GetFederatedToken gets an OpenID Connect access token from the identity
+// provider and exchanges it for an unscoped Keystone token
+func (k *KeystoneClient) GetFederatedToken(creds *Credentials) (string, error) {
+	debugf("GetFederatedToken called for identity provider %s (protocol: %s)\n", creds.IdentityProvider, creds.Protocol)
+
+	if creds.IdentityProvider == "" || creds.Protocol == "" {
+		return "", fmt.Errorf("OS_IDENTITY_PROVIDER and OS_PROTOCOL are required for %s", creds.AuthType)
+	}
+
+	accessToken, err := k.getOIDCAccessToken(creds)
+	if err != nil {
+		return "", err
+	}
+
+	path := fmt.Sprintf("/v3/OS-FEDERATION/identity_providers/%s/protocols/%s/auth",
+		url.PathEscape(creds.IdentityProvider), url.PathEscape(creds.Protocol))
+	fedURL := getUrlPath(creds.AuthURL, path)
+
+	req, err := http.NewRequest("POST", fedURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	debugf("Making federated token request to: %s\n", fedURL)
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	debugf("Federated auth response status: %s (%d)\n", resp.Status, resp.StatusCode)
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", &KeystoneError{Message: "federated authentication failed", Status: resp.Status, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	token := resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		return "", fmt.Errorf("no token received")
+	}
+
+	debugf("Successfully obtained federated unscoped token (length: %d)\n", len(token))
+	return token, nil
+}
+
+// getOIDCAccessToken runs the OAuth 2.0 grant for the credential's auth type
+func (k *KeystoneClient) getOIDCAccessToken(creds *Credentials) (string, error) {
+	if creds.ClientID == "" {
+		return "", fmt.Errorf("OS_CLIENT_ID is required for %s", creds.AuthType)
+	}
+
+	discovery, err := k.discoverOIDC(creds)
+	if err != nil {
+		return "", err
+	}
+	if discovery.TokenEndpoint == "" {
+		return "", fmt.Errorf("no token endpoint found, set OS_DISCOVERY_ENDPOINT or OS_ACCESS_TOKEN_ENDPOINT")
+	}
+
+	scope := creds.OpenIDScope
+	if scope == "" {
+		scope = "openid"
+	}
+
+	var form url.Values
+	switch creds.AuthType {
+	case authTypeOIDCPassword:
+		if err := ensurePassword(creds); err != nil {
+			return "", err
+		}
+		form = url.Values{
+			"grant_type": {grantTypePassword},
+			"username":   {creds.Username},
+			"password":   {creds.Password},
+			"scope":      {scope},
+		}
+	case authTypeOIDCClientCredentials:
+		form = url.Values{
+			"grant_type": {grantTypeClientCredentials},
+			"scope":      {scope},
+		}
+	case authTypeOIDCDeviceAuthz:
+		return k.getOIDCDeviceToken(creds, discovery, scope)
+	default:
+		return "", fmt.Errorf("unsupported auth type %q", creds.AuthType)
+	}
+
+	// Public clients have no secret to authenticate with, so they identify
+	// themselves in the form, as in the device flow
+	if creds.ClientSecret == "" {
+		form.Set("client_id", creds.ClientID)
+	}
+
+	debugf("Requesting OIDC access token with %s grant\n", form.Get("grant_type"))
+	tokenResp, err := k.postOIDCForm(creds, discovery.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	if tokenResp.Error != "" {
+		return "", fmt.Errorf("identity provider returned %s: %s", tokenResp.Error, tokenResp.ErrorDescription)
+	}
+	return oidcTokenFromResponse(creds, tokenResp)
+}
+
+// getOIDCDeviceToken runs the device authorization grant, showing the
+// verification URL and code on the terminal and polling until the user has
+// approved the request
+func (k *KeystoneClient) getOIDCDeviceToken(creds *Credentials, discovery *oidcDiscovery, scope string) (string, error) {
+	if discovery.DeviceAuthorizationEndpoint == "" {
+		return "", fmt.Errorf("no device authorization endpoint found, set OS_DISCOVERY_ENDPOINT or OS_DEVICE_AUTHORIZATION_ENDPOINT")
+	}
+
+	form := url.Values{
+		"client_id": {creds.ClientID},
+		"scope":     {scope},
+	}
+
+	debugf("Requesting device authorization from: %s\n", discovery.DeviceAuthorizationEndpoint)
+	resp, err := k.postForm(creds, discovery.DeviceAuthorizationEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("device authorization failed: %s - %s", resp.Status, string(resp.Body))
+	}
+
+	var deviceAuth oidcDeviceAuthResponse
+	if err := json.Unmarshal(resp.Body, &deviceAuth); err != nil {
+		return "", fmt.Errorf("failed to parse device authorization response: %v", err)
+	}
+
+	if err := ShowDeviceAuthorization(deviceAuth.VerificationURI, deviceAuth.VerificationURIComplete, deviceAuth.UserCode); err != nil {
+		return "", err
+	}
+
+	interval := time.Duration(deviceAuth.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	expiresIn := time.Duration(deviceAuth.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 10 * time.Minute
+	}
+	deadline := time.Now().Add(expiresIn)
+
+	pollForm := url.Values{
+		"grant_type":  {grantTypeDeviceCode},
+		"device_code": {deviceAuth.DeviceCode},
+		"client_id":   {creds.ClientID},
+	}
+
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		tokenResp, err := k.postOIDCForm(creds, discovery.TokenEndpoint, pollForm)
+		if err != nil {
+			return "", err
+		}
+
+		switch tokenResp.Error {
+		case "":
+			return oidcTokenFromResponse(creds, tokenResp)
+		case "authorization_pending":
+			debugf("Device authorization pending\n")
+		case "slow_down":
+			interval += 5 * time.Second
+			debugf("Identity provider asked us to slow down, polling every %s\n", interval)
+		default:
+			return "", fmt.Errorf("device authorization failed: %s: %s", tokenResp.Error, tokenResp.ErrorDescription)
+		}
+	}
+
+	return "", fmt.Errorf("device authorization timed out")
+}
+
+// discoverOIDC fetches the identity provider's discovery document, unless
+// the endpoints have been set explicitly
+func (k *KeystoneClient) discoverOIDC(creds *Credentials) (*oidcDiscovery, error) {
+	discovery := &oidcDiscovery{}
+
+	if creds.DiscoveryEndpoint != "" {
+		debugf("Fetching OIDC discovery document from: %s\n", creds.DiscoveryEndpoint)
+		resp, err := k.httpClient.Get(creds.DiscoveryEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch OIDC discovery document: %s - %s", resp.Status, string(body))
+		}
+
+		if err := json.Unmarshal(body, discovery); err != nil {
+			return nil, fmt.Errorf("failed to parse OIDC discovery document: %v", err)
+		}
+	}
+
+	if creds.AccessTokenEndpoint != "" {
+		discovery.TokenEndpoint = creds.AccessTokenEndpoint
+	}
+	if creds.DeviceAuthEndpoint != "" {
+		discovery.DeviceAuthorizationEndpoint = creds.DeviceAuthEndpoint
+	}
+
+	return discovery, nil
+}
+
+type formResponse struct {
+	Status     string
+	StatusCode int
+	Body       []byte
+}
+
+// postForm posts a form to the identity provider, authenticating as the
+// client with HTTP basic auth when a client secret is set
+func (k *KeystoneClient) postForm(creds *Credentials, endpoint string, form url.Values) (*formResponse, error) {
+	req, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if creds.ClientSecret != "" {
+		req.SetBasicAuth(creds.ClientID, creds.ClientSecret)
+	}
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	debugf("Identity provider response status: %s (%d)\n", resp.Status, resp.StatusCode)
+	return &formResponse{Status: resp.Status, StatusCode: resp.StatusCode, Body: body}, nil
+}
+
+// postOIDCForm posts to the token endpoint. OAuth errors come back as a 400
+// with an error code in the body, which is returned rather than failing so
+// the device flow can keep polling.
+func (k *KeystoneClient) postOIDCForm(creds *Credentials, endpoint string, form url.Values) (*oidcTokenResponse, error) {
+	resp, err := k.postForm(creds, endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenResp oidcTokenResponse
+	if err := json.Unmarshal(resp.Body, &tokenResp); err != nil {
+		return nil, fmt.Errorf("failed to get OIDC access token: %s - %s", resp.Status, string(resp.Body))
+	}
+
+	if resp.StatusCode != http.StatusOK && tokenResp.Error == "" {
+		return nil, fmt.Errorf("failed to get OIDC access token: %s - %s", resp.Status, string(resp.Body))
+	}
+
+	return &tokenResp, nil
+}
+
+// oidcTokenFromResponse picks the token Keystone expects, set by
+// OS_ACCESS_TOKEN_TYPE as in keystoneauth
+func oidcTokenFromResponse(creds *Credentials, tokenResp *oidcTokenResponse) (string, error) {
+	tokenType := creds.AccessTokenType
+	if tokenType == "" {
+		tokenType = "access_token"
+	}
+
+	token := tokenResp.AccessToken
+	if tokenType == "id_token" {
+		token = tokenResp.IDToken
+	}
+	if token == "" {
+		return "", fmt.Errorf("identity provider did not return an %s", tokenType)
+	}
+
+	debugf("Obtained OIDC token (length: %d)\n", len(token))
+	return token, nil
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// openrcParser reads the POSIX shell subset used in openrc files: variable
+// assignments, export, declare, unset and read, with quoting, escapes,
+// comments, line continuations and $VAR expansion. Other commands, such as
+// echo, are skipped, as oscreds can't run them.
+type openrcParser struct {
+	src    string
+	pos    int
+	line   int
+	values map[string]string
+	order  []string
+	lookup func(name string) (string, bool)
+	// read holds the variables set by read, which are left out of the
+	// result. Horizon's openrc files read the password this way.
+	read map[string]bool
+}
+
+// parseOpenrc returns the variables an openrc sets, in the order they were
+// first set. Variables the file doesn't set are looked up with lookup.
+func parseOpenrc(text string, lookup func(name string) (string, bool)) ([]EnvVar, error) {
+	p := &openrcParser{
+		src:    strings.ReplaceAll(text, "\r\n", "\n"),
+		line:   1,
+		values: map[string]string{},
+		lookup: lookup,
+		read:   map[string]bool{},
+	}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	vars := make([]EnvVar, 0, len(p.order))
+	for _, name := range p.order {
+		if !p.read[name] {
+			vars = append(vars, EnvVar{Key: name, Value: p.values[name]})
+		}
+	}
+	return vars, nil
+}
+
+// openrcEnvLookup expands variables from the environment, other than OS_*
+// ones, which may be left over from the credential loaded before
+func openrcEnvLookup(name string) (string, bool) {
+	if strings.HasPrefix(name, "OS_") {
+		return "", false
+	}
+	return os.LookupEnv(name)
+}
+
+func (p *openrcParser) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *openrcParser) peek() byte {
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *openrcParser) next() byte {
+	c := p.peek()
+	if c != 0 {
+		p.pos++
+		if c == '\n' {
+			p.line++
+		}
+	}
+	return c
+}
+
+func (p *openrcParser) set(name, value string) {
+	delete(p.read, name)
+	if _, ok := p.values[name]; !ok {
+		p.order = append(p.order, name)
+	}
+	p.values[name] = value
+}
+
+func (p *openrcParser) unset(name string) {
+	if _, ok := p.values[name]; !ok {
+		return
+	}
+	delete(p.values, name)
+	for i, n := range p.order {
+		if n == name {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// get returns a variable's value and whether it is set
+func (p *openrcParser) get(name string) (string, bool) {
+	if value, ok := p.values[name]; ok {
+		return value, true
+	}
+	if p.lookup != nil {
+		return p.lookup(name)
+	}
+	return "", false
+}
+
+// skipBlanks skips spaces, tabs and line continuations
+func (p *openrcParser) skipBlanks() {
+	for {
+		switch {
+		case p.peek() == ' ' || p.peek() == '\t':
+			p.next()
+		case strings.HasPrefix(p.src[p.pos:], "\\\n"):
+			p.next()
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+func (p *openrcParser) skipComment() {
+	for c := p.peek(); c != 0 && c != '\n'; c = p.peek() {
+		p.next()
+	}
+}
+
+// atEnd reports whether the statement ends here, skipping any comment
+func (p *openrcParser) atEnd() bool {
+	p.skipBlanks()
+	if p.peek() == '#' {
+		p.skipComment()
+	}
+	c := p.peek()
+	return c == 0 || c == '\n' || c == ';'
+}
+
+func (p *openrcParser) parse() error {
+	for {
+		p.skipBlanks()
+		switch p.peek() {
+		case 0:
+			return nil
+		case '\n', ';':
+			p.next()
+		case '#':
+			p.skipComment()
+		default:
+			if err := p.statement(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || (c >= '0' && c <= '9')
+}
+
+// assignmentName returns the name if the next word is an assignment, and
+// moves past the =
+func (p *openrcParser) assignmentName() (string, bool) {
+	end := p.pos
+	if end >= len(p.src) || !isNameStart(p.src[end]) {
+		return "", false
+	}
+	for end < len(p.src) && isNameChar(p.src[end]) {
+		end++
+	}
+	if end >= len(p.src) || p.src[end] != '=' {
+		return "", false
+	}
+	name := p.src[p.pos:end]
+	p.pos = end + 1
+	return name, true
+}
+
+// assignmentValue reads the value after NAME=, expanding a leading ~ to the
+// home directory as the shell does
+func (p *openrcParser) assignmentValue() (string, error) {
+	home := ""
+	if p.peek() == '~' {
+		rest := p.src[p.pos+1:]
+		if rest == "" || strings.IndexByte("/ \t\n;", rest[0]) >= 0 {
+			p.next()
+			home, _ = p.get("HOME")
+		}
+	}
+	value, err := p.word(true)
+	return home + value, err
+}
+
+// statement runs one simple command
+func (p *openrcParser) statement() error {
+	line := p.line
+
+	// Assignments, which only set shell variables when no command follows
+	type assignment struct{ name, value string }
+	var assignments []assignment
+	for {
+		name, ok := p.assignmentName()
+		if !ok {
+			break
+		}
+		value, err := p.assignmentValue()
+		if err != nil {
+			return err
+		}
+		assignments = append(assignments, assignment{name, value})
+		if p.atEnd() {
+			for _, a := range assignments {
+				p.set(a.name, a.value)
+			}
+			return nil
+		}
+	}
+
+	command, err := p.word(false)
+	if err != nil {
+		return err
+	}
+	switch command {
+	case "export", "unset", "read", "declare", "typeset", "readonly":
+		// Whether assignments before a builtin are kept differs between bash
+		// and POSIX shells
+		if len(assignments) > 0 {
+			return p.errorf(line, "variable assignments before %s aren't supported", command)
+		}
+	case "source", ".":
+		return p.errorf(line, "%s isn't supported, use OS_CRED_INCLUDE to include other entries", command)
+	default:
+		if len(assignments) > 0 {
+			debugf("openrc line %d: skipping %q command with variable assignments\n", line, command)
+		} else {
+			debugf("openrc line %d: skipping %q command\n", line, command)
+		}
+		return p.skipStatement()
+	}
+
+	for !p.atEnd() {
+		if c := p.peek(); strings.IndexByte("&|<>()", c) >= 0 {
+			return p.errorf(p.line, "unsupported %q after %s", c, command)
+		}
+		if command != "unset" && command != "read" {
+			if name, ok := p.assignmentName(); ok {
+				value, err := p.assignmentValue()
+				if err != nil {
+					return err
+				}
+				p.set(name, value)
+				continue
+			}
+		}
+		arg, err := p.word(true)
+		if err != nil {
+			return err
+		}
+		if (command == "declare" || command == "typeset") && len(arg) > 1 && (arg[0] == '-' || arg[0] == '+') {
+			// Attributes like arrays and integers change what a value means,
+			// so only export, global and readonly are allowed
+			if strings.Trim(arg[1:], "xgr") != "" {
+				return p.errorf(line, "unsupported %s option %s", command, arg)
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			// Skip the argument of read options like -p prompt
+			if command == "read" && strings.ContainsAny(arg[len(arg)-1:], "adnNptu") && !p.atEnd() {
+				if _, err := p.word(false); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		switch command {
+		case "unset":
+			p.unset(arg)
+		case "read":
+			// There's no input to read, so the variable is empty, as it would
+			// be in a shell without a terminal
+			debugf("openrc line %d: %s is read from the terminal\n", line, arg)
+			p.set(arg, "")
+			p.read[arg] = true
+		}
+	}
+	return nil
+}
+
+// skipStatement moves past the rest of a command oscreds doesn't run
+func (p *openrcParser) skipStatement() error {
+	for !p.atEnd() {
+		if strings.IndexByte("&|<>()", p.peek()) >= 0 {
+			p.next()
+			continue
+		}
+		if _, err := p.word(false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// word reads a shell word, removing quotes and escapes. Variables are
+// expanded if expand is set, otherwise they are kept as written.
+func (p *openrcParser) word(expand bool) (string, error) {
+	var b strings.Builder
+	err := p.readWord(&b, expand, false, false)
+	return b.String(), err
+}
+
+// readWord reads a word into b, up to a blank or operator, or with inBraces,
+// up to the } that ends the word in ${NAME:-word}. quoted is set for a
+// ${NAME:-word} in double quotes, where the quoting rules of double quotes
+// apply to the word.
+func (p *openrcParser) readWord(b *strings.Builder, expand, inBraces, quoted bool) error {
+	line := p.line
+	for {
+		c := p.peek()
+		switch {
+		case inBraces && c == '}':
+			return nil
+		case inBraces && c == 0:
+			return p.errorf(line, "unterminated ${")
+		case !inBraces && (c == 0 || strings.IndexByte(" \t\n;&|<>()", c) >= 0):
+			return nil
+		}
+
+		switch c {
+		case '\\':
+			p.next()
+			switch n := p.peek(); {
+			case n == '\n':
+				p.next()
+			case n == 0:
+			case !quoted || strings.IndexByte("$`\"\\}", n) >= 0:
+				b.WriteByte(p.next())
+			default:
+				b.WriteByte('\\')
+			}
+
+		case '\'':
+			if quoted {
+				b.WriteByte(p.next())
+			} else if err := p.singleQuoted(b); err != nil {
+				return err
+			}
+
+		case '"':
+			if err := p.doubleQuoted(b, expand); err != nil {
+				return err
+			}
+
+		case '$':
+			if !quoted && strings.HasPrefix(p.src[p.pos:], "$'") {
+				if expand {
+					return p.errorf(p.line, "ANSI-C quoting $'...' isn't supported")
+				}
+				start := p.pos
+				p.next()
+				if err := p.skipUntil('\''); err != nil {
+					return err
+				}
+				b.WriteString(p.src[start:p.pos])
+				continue
+			}
+			if err := p.dollar(b, expand, quoted); err != nil {
+				return err
+			}
+
+		case '`':
+			if expand {
+				return p.errorf(p.line, "command substitution isn't supported")
+			}
+			if err := p.skipUntil('`'); err != nil {
+				return err
+			}
+
+		default:
+			b.WriteByte(p.next())
+		}
+	}
+}
+
+// singleQuoted reads a single quoted string, where nothing is special
+func (p *openrcParser) singleQuoted(b *strings.Builder) error {
+	line := p.line
+	p.next()
+	for {
+		c := p.next()
+		if c == 0 {
+			return p.errorf(line, "unterminated single quote")
+		}
+		if c == '\'' {
+			return nil
+		}
+		b.WriteByte(c)
+	}
+}
+
+// doubleQuoted reads a double quoted string, where backslash only escapes
+// $, `, ", \ and newlines
+func (p *openrcParser) doubleQuoted(b *strings.Builder, expand bool) error {
+	line := p.line
+	p.next()
+	for {
+		switch c := p.peek(); c {
+		case 0:
+			return p.errorf(line, "unterminated double quote")
+		case '"':
+			p.next()
+			return nil
+		case '\\':
+			p.next()
+			switch n := p.peek(); n {
+			case '\n':
+				p.next()
+			case '$', '`', '"', '\\':
+				b.WriteByte(p.next())
+			default:
+				b.WriteByte('\\')
+			}
+		case '$':
+			if err := p.dollar(b, expand, true); err != nil {
+				return err
+			}
+		case '`':
+			if expand {
+				return p.errorf(p.line, "command substitution isn't supported")
+			}
+			if err := p.skipUntil('`'); err != nil {
+				return err
+			}
+		default:
+			b.WriteByte(p.next())
+		}
+	}
+}
+
+// skipUntil skips a backquoted command, which is only allowed in commands
+// oscreds doesn't run
+func (p *openrcParser) skipUntil(end byte) error {
+	line := p.line
+	p.next()
+	for {
+		c := p.next()
+		if c == 0 {
+			return p.errorf(line, "unterminated %c", end)
+		}
+		if c == '\\' {
+			p.next()
+		} else if c == end {
+			return nil
+		}
+	}
+}
+
+// dollar expands $NAME, ${NAME}, ${NAME:-word} and ${NAME-word}. quoted is
+// set inside double quotes.
+func (p *openrcParser) dollar(b *strings.Builder, expand, quoted bool) error {
+	line := p.line
+	p.next()
+	c := p.peek()
+
+	switch {
+	case c == '(':
+		if expand {
+			return p.errorf(line, "command substitution isn't supported")
+		}
+		// Skip to the matching parenthesis in a command that isn't run,
+		// reading the words in between so quoted parentheses don't count
+		p.next()
+		depth := 0
+		for {
+			p.skipBlanks()
+			switch p.peek() {
+			case 0:
+				return p.errorf(line, "unterminated $(")
+			case '#':
+				p.skipComment()
+			case '(':
+				depth++
+				p.next()
+			case ')':
+				p.next()
+				if depth == 0 {
+					return nil
+				}
+				depth--
+			case '\n', ';', '&', '|', '<', '>':
+				p.next()
+			default:
+				if _, err := p.word(false); err != nil {
+					return err
+				}
+			}
+		}
+
+	case c == '{':
+		p.next()
+		start := p.pos
+		value, err := p.braceExpansion(line, expand, quoted)
+		if err != nil {
+			return err
+		}
+		if expand {
+			b.WriteString(value)
+		} else {
+			b.WriteString("${" + p.src[start:p.pos])
+		}
+		return nil
+
+	case isNameStart(c):
+		start := p.pos
+		for isNameChar(p.peek()) {
+			p.next()
+		}
+		name := p.src[start:p.pos]
+		if expand {
+			value, _ := p.get(name)
+			b.WriteString(value)
+		} else {
+			b.WriteString("$" + name)
+		}
+		return nil
+
+	case c >= '0' && c <= '9' || strings.IndexByte("?$!#*@-", c) >= 0:
+		if expand {
+			return p.errorf(line, "unsupported special parameter $%c", c)
+		}
+		b.WriteByte('$')
+		b.WriteByte(p.next())
+		return nil
+	}
+
+	// A lone $ is literal
+	b.WriteByte('$')
+	return nil
+}
+
+// braceExpansion reads the rest of ${NAME}, ${NAME:-word} or ${NAME-word}
+// after the opening brace. The word is read like any other, with its own
+// quotes and expansions.
+func (p *openrcParser) braceExpansion(line int, expand, quoted bool) (string, error) {
+	start := p.pos
+	for isNameChar(p.peek()) {
+		p.next()
+	}
+	name := p.src[start:p.pos]
+
+	op := ""
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], ":-"):
+		op = ":-"
+	case p.peek() == '-':
+		op = "-"
+	}
+
+	if name == "" || !isNameStart(name[0]) || (op == "" && p.peek() != '}') {
+		if expand {
+			expr, _, found := strings.Cut(p.src[start:], "}")
+			if !found {
+				return "", p.errorf(line, "unterminated ${")
+			}
+			return "", p.errorf(line, "unsupported expansion ${%s}", expr)
+		}
+		// Other expansions are only skipped, in commands that aren't run
+		op = ""
+	}
+	p.pos += len(op)
+
+	var word strings.Builder
+	if err := p.readWord(&word, expand, true, quoted); err != nil {
+		return "", err
+	}
+	p.next()
+	if !expand {
+		return "", nil
+	}
+
+	value, set := p.get(name)
+	if (op == ":-" && value == "") || (op == "-" && !set) {
+		value = word.String()
+	}
+	return value, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOpenrc(t *testing.T) {
+	env := map[string]string{"HOME": "/home/user", "Y": "v", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want []EnvVar
+	}{
+		{
+			name: "assignments",
+			text: "export OS_AUTH_URL=https://keystone:5000/v3\nOS_USERNAME=alice\nexport OS_USERNAME\n",
+			want: []EnvVar{{"OS_AUTH_URL", "https://keystone:5000/v3"}, {"OS_USERNAME", "alice"}},
+		},
+		{
+			name: "several on a line",
+			text: "export A=1 B=2; C=3 D=4",
+			want: []EnvVar{{"A", "1"}, {"B", "2"}, {"C", "3"}, {"D", "4"}},
+		},
+		{
+			name: "single quotes",
+			text: `A='a "b" $Y \n'`,
+			want: []EnvVar{{"A", `a "b" $Y \n`}},
+		},
+		{
+			name: "double quotes",
+			text: `A="a 'b' $Y \$Y \" \\ \n"`,
+			want: []EnvVar{{"A", `a 'b' v $Y " \ \n`}},
+		},
+		{
+			name: "escapes",
+			text: `A=a\ b\$Y\'\"\\`,
+			want: []EnvVar{{"A", `a b$Y'"\`}},
+		},
+		{
+			name: "mixed quoting",
+			text: `A=x'y z'"$Y"w`,
+			want: []EnvVar{{"A", "xy zvw"}},
+		},
+		{
+			name: "comments",
+			text: "# A=1\nB=2 # C=3\nD=x#y\n  # E=5",
+			want: []EnvVar{{"B", "2"}, {"D", "x#y"}},
+		},
+		{
+			name: "continuations",
+			text: "export \\\nA=1 \\\n  B=2\nC=\"x\\\ny\"\nD=x\\\ny",
+			want: []EnvVar{{"A", "1"}, {"B", "2"}, {"C", "xy"}, {"D", "xy"}},
+		},
+		{
+			name: "crlf",
+			text: "A=1\r\nB=2\r\n",
+			want: []EnvVar{{"A", "1"}, {"B", "2"}},
+		},
+		{
+			name: "unset",
+			text: "A=1\nB=2\nC=3\nunset A C\nunset -v B\nC=4",
+			want: []EnvVar{{"C", "4"}},
+		},
+		{
+			name: "variables",
+			text: "A=$Y/${Y}/$UNSET/$EMPTY\nB=$A-x\nC=$",
+			want: []EnvVar{{"A", "v/v//"}, {"B", "v/v//-x"}, {"C", "$"}},
+		},
+		{
+			name: "defaults",
+			text: "A=${X:-$Y}\nB=${X:-\"a b\"}\nC=${X:-'q'}\nD=\"${X:-'q'}\"\nE=\"${X:-\"a b\"}\"\n" +
+				"F=${EMPTY-d}\nG=${EMPTY:-d}\nH=\"${X:-\\a\\$}\"\nI=${X:-\\a}\nJ=${Y:-d}",
+			want: []EnvVar{
+				{"A", "v"}, {"B", "a b"}, {"C", "q"}, {"D", "'q'"}, {"E", "a b"},
+				{"F", ""}, {"G", "d"}, {"H", `\a$`}, {"I", "a"}, {"J", "v"},
+			},
+		},
+		{
+			name: "home",
+			text: "A=~\nB=~/x\nC=~user\nD=x~",
+			want: []EnvVar{{"A", "/home/user"}, {"B", "/home/user/x"}, {"C", "~user"}, {"D", "x~"}},
+		},
+		{
+			name: "skipped commands",
+			text: "echo \"Project $(whoami)\" `id` > /dev/null\n[ -z \"$A\" ] && true\nA=2 cmd\nB=3",
+			want: []EnvVar{{"B", "3"}},
+		},
+		{
+			name: "declare",
+			text: "declare -x A=1 B\ntypeset -gx C=2\nreadonly D=3\ndeclare +x E=$A",
+			want: []EnvVar{{"A", "1"}, {"C", "2"}, {"D", "3"}, {"E", "1"}},
+		},
+		{
+			name: "horizon password prompt",
+			text: "export OS_USERNAME=alice\n" +
+				"echo \"Please enter your OpenStack Password for project $OS_PROJECT_NAME as user $OS_USERNAME: \"\n" +
+				"read -sr OS_PASSWORD_INPUT\n" +
+				"export OS_PASSWORD=$OS_PASSWORD_INPUT\n",
+			want: []EnvVar{{"OS_USERNAME", "alice"}, {"OS_PASSWORD", ""}},
+		},
+		{
+			name: "read with prompt",
+			text: "read -p 'Password: ' -s PW\nexport OS_PASSWORD=$PW",
+			want: []EnvVar{{"OS_PASSWORD", ""}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOpenrc(tt.text, lookup)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOpenrcErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"unterminated single quote", "A=1\nB='x\n\n", "line 2: unterminated single quote"},
+		{"unterminated double quote", "A=1\n\nB=\"x", "line 3: unterminated double quote"},
+		{"command substitution", "A=$(whoami)", "line 1: command substitution isn't supported"},
+		{"quoted command substitution", "A=\"$(whoami)\"", "line 1: command substitution isn't supported"},
+		{"backquotes", "A=`whoami`", "line 1: command substitution isn't supported"},
+		{"quoted backquotes", "A=\"`whoami`\"", "line 1: command substitution isn't supported"},
+		{"substitution in default", "A=${X:-$(whoami)}", "line 1: command substitution isn't supported"},
+		{"ansi-c quoting", "A=1\nB=$'x\\ty'", "line 2: ANSI-C quoting $'...' isn't supported"},
+		{"unterminated brace", "A=${X", "line 1: unterminated ${"},
+		{"unterminated brace default", "A=${X:-abc", "line 1: unterminated ${"},
+		{"unsupported expansion", "A=${#X}", "line 1: unsupported expansion ${#X}"},
+		{"unsupported operator", "A=${X%.*}", "line 1: unsupported expansion ${X%.*}"},
+		{"special parameter", "A=$1", "line 1: unsupported special parameter $1"},
+		{"assignment before export", "A=1 export B=2", "line 1: variable assignments before export aren't supported"},
+		{"assignment before unset", "A=1\nB=2 unset A", "line 2: variable assignments before unset aren't supported"},
+		{"declare array", "declare -a A=(1 2)", "line 1: unsupported declare option -a"},
+		{"typeset integer", "typeset -ix A=1+1", "line 1: unsupported typeset option -ix"},
+		{"source", "source common.rc", "line 1: source isn't supported"},
+		{"dot", "A=1\n. ./common.rc", "line 2: . isn't supported"},
+		{"pipe after export", "export A=1 | cat", "line 1: unsupported '|' after export"},
+		{"unterminated backquote", "echo `id", "line 1: unterminated `"},
+		{"unterminated substitution", "echo $(id", "line 1: unterminated $("},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOpenrc(tt.text, nil)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("got error %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOpenrcSkipsANSIQuotingInSkippedCommands(t *testing.T) {
+	got, err := parseOpenrc("echo $'a b\\'c' ${#X} $1 $(echo 'a)b' \"(\" $(id)) `x`\nA=1", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []EnvVar{{"A", "1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Output formats, selected with --format
+const (
+	formatShell      = "shell"
+	formatJSON       = "json"
+	formatCloudsYAML = "clouds-yaml"
+	formatOSCloud    = "os-cloud"
+	formatEnv        = "env"
+	formatSystemd    = "systemd"
+	formatDotenv     = "dotenv"
+)
+
+var outputFormats = []string{formatShell, formatJSON, formatCloudsYAML, formatOSCloud, formatEnv, formatSystemd, formatDotenv}
+
+var outputFormat = formatShell
+
+// cloudsFile is the clouds.yaml the clouds-yaml and os-cloud formats write to
+var cloudsFile string
+
+// outputFile is written instead of stdout when set with --output
+var outputFile string
+
+// envFileQuoters quote values for the KEY=value files read by other tools
+var envFileQuoters = map[string]func(value string) (string, error){
+	formatEnv:     dockerEnvValue,
+	formatSystemd: systemdEscape,
+	formatDotenv:  dotenvEscape,
+}
+
+// validateOutputFormat checks --format and --shell before authenticating, so
+// a typo doesn't cost a TOTP code
+func validateOutputFormat() error {
+	found := false
+	for _, format := range outputFormats {
+		found = found || format == outputFormat
+	}
+	if !found {
+		return fmt.Errorf("unsupported format %q (use %s)", outputFormat, strings.Join(outputFormats, ", "))
+	}
+	if _, ok := shells[shellType]; !ok {
+		return fmt.Errorf("unsupported shell type %q (use %s)", shellType, shellNames())
+	}
+	return nil
+}
+
+// outputVars writes the variables in the selected format to stdout, or to
+// the --output file
+func outputVars(vars []EnvVar, session *Session) {
+	var buf bytes.Buffer
+	if err := writeVars(&buf, vars, session); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if outputFile == "" {
+		os.Stdout.Write(buf.Bytes())
+		return
+	}
+
+	if err := writePrivateFile(outputFile, buf.Bytes()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", outputFile, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Saved credentials to %s\n", outputFile)
+}
+
+// writeVars writes the variables in the selected format. The OS_CRED entry
+// names the cloud in the clouds.yaml formats. The session, if any, adds the
+// token details to the JSON format.
+func writeVars(w io.Writer, vars []EnvVar, session *Session) error {
+	switch outputFormat {
+	case formatJSON:
+		data, err := json.MarshalIndent(credentialsJSON(vars, session), "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode JSON: %v", err)
+		}
+		fmt.Fprintln(w, string(data))
+
+	case formatCloudsYAML:
+		name, entry := cloudEntry(vars)
+		if cloudsFile == "" {
+			data, err := cloudsYAML(name, entry)
+			if err != nil {
+				return fmt.Errorf("failed to generate clouds.yaml: %v", err)
+			}
+			w.Write(data)
+			return nil
+		}
+		if err := mergeCloudsFile(cloudsFile, name, entry); err != nil {
+			return fmt.Errorf("failed to update %s: %v", cloudsFile, err)
+		}
+		fmt.Fprintf(os.Stderr, "Saved cloud %s to %s\n", name, cloudsFile)
+
+	case formatOSCloud:
+		name, entry := cloudEntry(vars)
+		file := cloudsFile
+		if file == "" {
+			var err error
+			file, err = defaultCloudsFile()
+			if err != nil {
+				return fmt.Errorf("failed to find clouds.yaml location: %v", err)
+			}
+		}
+		if err := mergeCloudsFile(file, name, entry); err != nil {
+			return fmt.Errorf("failed to update %s: %v", file, err)
+		}
+		currentShell().setVars(w, []EnvVar{
+			{Key: "OS_CRED", Value: name},
+			{Key: "OS_CLOUD", Value: name},
+			{Key: "OS_CLIENT_CONFIG_FILE", Value: file},
+		})
+
+	case formatEnv, formatSystemd, formatDotenv:
+		quote := envFileQuoters[outputFormat]
+		for _, v := range vars {
+			value, err := quote(v.Value)
+			if err != nil {
+				return fmt.Errorf("can't write %s in %s format: %v", v.Key, outputFormat, err)
+			}
+			fmt.Fprintf(w, "%s=%s\n", v.Key, value)
+		}
+
+	default:
+		currentShell().setVars(w, vars)
+	}
+	return nil
+}
+
+// sessionVars returns the variables for the session's scope
+func sessionVars(s *Session) []EnvVar {
+	switch s.Scope {
+	case scopeSystem:
+		return systemScopeVars(s.CredFile, s.Token, s.Creds)
+	case scopeDomain:
+		return domainScopeVars(s.CredFile, s.Token, s.Creds)
+	default:
+		return environmentVars(s.CredFile, s.Project, s.Token, s.Creds)
+	}
+}
+
+// nonSettingKeys are the openrc variables, besides the clouds.yaml auth ones,
+// that select how to authenticate or what to scope to. They would conflict
+// with the exported token or password.
+var nonSettingKeys = map[string]bool{
+	"OS_AUTH_TYPE":                     true,
+	"OS_AUTH_METHODS":                  true,
+	"OS_IDENTITY_API_VERSION":          true,
+	"OS_DEVICE_AUTHORIZATION_ENDPOINT": true,
+	"OS_PASSCODE":                      true,
+	"OS_TRUST_ID":                      true,
+	"OS_TENANT_ID":                     true,
+	"OS_TENANT_NAME":                   true,
+	"OS_DEFAULT_DOMAIN":                true,
+	"OS_DEFAULT_DOMAIN_ID":             true,
+	"OS_DEFAULT_DOMAIN_NAME":           true,
+	"OS_CLOUD":                         true,
+	"OS_CLIENT_CONFIG_FILE":            true,
+}
+
+// settingVars returns the openrc's other OS_* variables, such as
+// OS_INTERFACE or OS_COMPUTE_API_VERSION, skipping the auth, scope and secret
+// ones and any already in vars
+func settingVars(creds *Credentials, vars []EnvVar) []EnvVar {
+	set := map[string]bool{}
+	for _, v := range vars {
+		set[v.Key] = true
+	}
+
+	var settings []EnvVar
+	for _, v := range creds.RawVars {
+		switch {
+		case set[v.Key]:
+		case cloudAuthKeys[v.Key] || nonSettingKeys[v.Key]:
+			debugf("Not exporting %s from the credential file\n", v.Key)
+		case strings.Contains(v.Key, "PASSWORD") || strings.Contains(v.Key, "SECRET") || strings.Contains(v.Key, "TOKEN"):
+			debugf("Not exporting %s from the credential file\n", v.Key)
+		default:
+			settings = append(settings, v)
+			set[v.Key] = true
+		}
+	}
+	return settings
+}
+
+// metadataVars returns the token details for prompts and scripts. The
+// expiry is left out in password mode, where clients fetch their own tokens.
+func metadataVars(s *Session) []EnvVar {
+	token := s.TokenResponse.Token
+	var vars []EnvVar
+
+	if authMode != authModePassword {
+		if expires, err := s.TokenResponse.ExpiresAt(); err == nil {
+			vars = append(vars, EnvVar{Key: "OS_CRED_EXPIRES_AT", Value: expires.UTC().Format(time.RFC3339)})
+		} else {
+			debugf("Not exporting token expiry: %v\n", err)
+		}
+	}
+
+	user := token.User.Name
+	if user == "" {
+		user = token.User.ID
+	}
+	vars = append(vars, EnvVar{Key: "OS_CRED_USER", Value: user})
+
+	var roles []string
+	for _, role := range token.Roles {
+		roles = append(roles, role.Name)
+	}
+	vars = append(vars, EnvVar{Key: "OS_CRED_ROLES", Value: strings.Join(roles, ",")})
+
+	scope := s.Scope
+	switch s.Scope {
+	case scopeProject:
+		scope += ":" + token.Project.Name
+	case scopeDomain:
+		scope += ":" + token.Domain.Name
+	case scopeSystem:
+		scope += ":" + s.Creds.SystemScope
+	}
+	return append(vars, EnvVar{Key: "OS_CRED_SCOPE", Value: scope})
+}
+
+// passthroughVars returns the credential file's variables, with the password
+// if it was prompted for
+func passthroughVars(credFile CredentialFile, creds *Credentials) []EnvVar {
+	vars := []EnvVar{{Key: "OS_CRED", Value: credFile.DisplayName}}
+	hasPassword := false
+	for _, v := range creds.RawVars {
+		if v.Key == "OS_PASSWORD" {
+			v.Value = creds.Password
+			hasPassword = true
+		}
+		vars = append(vars, v)
+	}
+	if !hasPassword && creds.Password != "" {
+		vars = append(vars, EnvVar{Key: "OS_PASSWORD", Value: creds.Password})
+	}
+	return vars
+}
+
+// authVars returns either the fetched token or, in password mode, the
+// username/password identity so clients authenticate themselves
+func authVars(token string, creds *Credentials) []EnvVar {
+	if authMode == authModePassword {
+		vars := []EnvVar{
+			{Key: "OS_AUTH_TYPE", Value: authModePassword},
+			{Key: "OS_USERNAME", Value: creds.Username},
+			{Key: "OS_PASSWORD", Value: creds.Password},
+		}
+		if creds.UserDomainId != "" {
+			vars = append(vars, EnvVar{Key: "OS_USER_DOMAIN_ID", Value: creds.UserDomainId})
+		} else {
+			vars = append(vars, EnvVar{Key: "OS_USER_DOMAIN_NAME", Value: creds.UserDomainName})
+		}
+		return vars
+	}
+	return []EnvVar{
+		{Key: "OS_TOKEN", Value: token},
+		{Key: "OS_AUTH_TYPE", Value: authModeToken},
+	}
+}
+
+// regionVars returns the region, if the credential sets one
+func regionVars(creds *Credentials) []EnvVar {
+	if creds.Region == "" {
+		return nil
+	}
+	return []EnvVar{{Key: "OS_REGION_NAME", Value: creds.Region}}
+}
+
+func environmentVars(credFile CredentialFile, project *Project, token string, creds *Credentials) []EnvVar {
+	vars := []EnvVar{
+		{Key: "OS_CRED", Value: credFile.DisplayName},
+		{Key: "OS_IDENTITY_API_VERSION", Value: "3"},
+		{Key: "OS_AUTH_URL", Value: creds.AuthURL},
+		{Key: "OS_PROJECT_ID", Value: project.ID},
+	}
+	if authMode == authModePassword && project.Name != "" {
+		vars = append(vars, EnvVar{Key: "OS_PROJECT_NAME", Value: project.Name})
+	}
+	vars = append(vars, authVars(token, creds)...)
+	return append(vars, regionVars(creds)...)
+}
+
+func domainScopeVars(credFile CredentialFile, token string, creds *Credentials) []EnvVar {
+	vars := []EnvVar{
+		{Key: "OS_CRED", Value: credFile.DisplayName + "/domain"},
+		{Key: "OS_IDENTITY_API_VERSION", Value: "3"},
+		{Key: "OS_AUTH_URL", Value: creds.AuthURL},
+	}
+	if creds.DomainID != "" {
+		vars = append(vars, EnvVar{Key: "OS_DOMAIN_ID", Value: creds.DomainID})
+	} else {
+		vars = append(vars, EnvVar{Key: "OS_DOMAIN_NAME", Value: creds.DomainName})
+	}
+	vars = append(vars, authVars(token, creds)...)
+	return append(vars, regionVars(creds)...)
+}
+
+func systemScopeVars(credFile CredentialFile, token string, creds *Credentials) []EnvVar {
+	vars := []EnvVar{
+		{Key: "OS_CRED", Value: credFile.DisplayName + "/system"},
+		{Key: "OS_IDENTITY_API_VERSION", Value: "3"},
+		{Key: "OS_AUTH_URL", Value: creds.AuthURL},
+		{Key: "OS_SYSTEM_SCOPE", Value: creds.SystemScope},
+	}
+	vars = append(vars, authVars(token, creds)...)
+	return append(vars, regionVars(creds)...)
+}
+
+// jsonCredentials is the --format json output
+type jsonCredentials struct {
+	Credential string            `json:"credential"`
+	Scope      string            `json:"scope,omitempty"`
+	Variables  map[string]string `json:"variables"`
+	ExpiresAt  string            `json:"expires_at,omitempty"`
+	User       *jsonNamed        `json:"user,omitempty"`
+	Project    *jsonNamed        `json:"project,omitempty"`
+	Domain     *jsonNamed        `json:"domain,omitempty"`
+	System     string            `json:"system,omitempty"`
+	Roles      []string          `json:"roles,omitempty"`
+	Endpoints  []jsonEndpoint    `json:"endpoints,omitempty"`
+}
+
+type jsonNamed struct {
+	ID     string     `json:"id"`
+	Name   string     `json:"name,omitempty"`
+	Domain *jsonNamed `json:"domain,omitempty"`
+}
+
+type jsonEndpoint struct {
+	Type      string `json:"type"`
+	Name      string `json:"name,omitempty"`
+	Interface string `json:"interface"`
+	Region    string `json:"region,omitempty"`
+	URL       string `json:"url"`
+}
+
+// credentialsJSON builds the JSON output from the variables and, when a
+// token was fetched, its details
+func credentialsJSON(vars []EnvVar, session *Session) *jsonCredentials {
+	out := &jsonCredentials{Variables: map[string]string{}}
+	for _, v := range vars {
+		out.Variables[v.Key] = v.Value
+	}
+	out.Credential = out.Variables["OS_CRED"]
+
+	if session == nil || session.TokenResponse == nil {
+		return out
+	}
+
+	out.Scope = session.Scope
+	token := session.TokenResponse.Token
+	out.ExpiresAt = token.Expires
+	out.User = &jsonNamed{
+		ID:     token.User.ID,
+		Name:   token.User.Name,
+		Domain: &jsonNamed{ID: token.User.Domain.ID, Name: token.User.Domain.Name},
+	}
+
+	switch session.Scope {
+	case scopeProject:
+		out.Project = &jsonNamed{ID: token.Project.ID, Name: token.Project.Name}
+		if token.Project.Domain.ID != "" {
+			out.Project.Domain = &jsonNamed{ID: token.Project.Domain.ID, Name: token.Project.Domain.Name}
+		}
+	case scopeDomain:
+		out.Domain = &jsonNamed{ID: token.Domain.ID, Name: token.Domain.Name}
+	case scopeSystem:
+		out.System = session.Creds.SystemScope
+	}
+
+	for _, role := range token.Roles {
+		out.Roles = append(out.Roles, role.Name)
+	}
+	for _, service := range token.Catalog {
+		for _, endpoint := range service.Endpoints {
+			out.Endpoints = append(out.Endpoints, jsonEndpoint{
+				Type:      service.Type,
+				Name:      service.Name,
+				Interface: endpoint.Interface,
+				Region:    endpoint.Region,
+				URL:       endpoint.URL,
+			})
+		}
+	}
+	return out
+}
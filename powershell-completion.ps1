@@ -0,0 +1,58 @@
+# completion for chcreds, dot-source from your $PROFILE after powershell-functions.ps1
+
+$chcredsOptions = @{
+    '--debug'            = 'Enable debug output'
+    '--shell'            = 'Shell type for output format'
+    '--project'          = 'Project name to scope to'
+    '--region'           = 'Region to use'
+    '--token'            = 'Export token auth variables (default)'
+    '--password'         = 'Export password auth variables instead of a token'
+    '--metadata'         = "Export the token's expiry, user, roles and scope"
+    '--no-cache'         = 'Ignore cached tokens and request a fresh one'
+    '--refresh'          = 'Ignore cached tokens and request a fresh one'
+    '--refresh-projects' = 'Ignore the cached project list'
+    '--token-stdin'      = 'Authenticate with a Keystone token read from stdin'
+    '--format'           = 'Output format'
+    '--clouds-file'      = 'clouds.yaml file to save the cloud entry to'
+    '--output'           = 'Write the output to a file instead of stdout'
+}
+
+Register-ArgumentCompleter -CommandName chcreds -ParameterName Arguments -ScriptBlock {
+    param($commandName, $parameterName, $wordToComplete, $commandAst, $fakeBoundParameters)
+
+    $previous = $commandAst.CommandElements |
+        Where-Object { $_.Extent.EndOffset -lt $commandAst.Extent.EndOffset -and $_.Extent.Text -ne $wordToComplete } |
+        Select-Object -Last 1
+
+    $values = switch ($previous.Extent.Text) {
+        '--shell' { 'bash', 'zsh', 'fish', 'powershell', 'nushell', 'tcsh', 'elvish' }
+        '--format' { 'shell', 'json', 'clouds-yaml', 'os-cloud', 'env', 'systemd', 'dotenv' }
+    }
+    if ($values) {
+        $values | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+            [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+        }
+        return
+    }
+
+    if ($wordToComplete -like '-*') {
+        $chcredsOptions.Keys | Sort-Object | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+            [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterName', $chcredsOptions[$_])
+        }
+        return
+    }
+
+    & oscreds list 2>$null |
+        Where-Object { $_ -like "$wordToComplete*" } |
+        ForEach-Object {
+            [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+        }
+}
+
+Register-ArgumentCompleter -CommandName rmcreds -ParameterName Arguments -ScriptBlock {
+    param($commandName, $parameterName, $wordToComplete)
+
+    if ('--revoke' -like "$wordToComplete*") {
+        [System.Management.Automation.CompletionResult]::new('--revoke', '--revoke', 'ParameterName', 'Also revoke the token in Keystone')
+    }
+}
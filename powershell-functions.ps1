@@ -0,0 +1,46 @@
+# OpenStack credential functions for PowerShell, dot-source from your $PROFILE
+
+function chcreds {
+    param([Parameter(ValueFromRemainingArguments)][string[]]$Arguments)
+
+    $creds = & oscreds --shell powershell @Arguments
+    if ($LASTEXITCODE -ne 0) {
+        Write-Host "Failed to load credentials" -ForegroundColor Red
+        return
+    }
+    rmcreds
+    Invoke-Expression ($creds -join "`n")
+    Write-Host "Credentials loaded for $env:OS_CRED"
+}
+
+function recred {
+    chcreds $env:OS_CRED
+}
+
+# rmcreds [--revoke]: with --revoke, the token is also revoked in Keystone
+# before the variables are cleared
+function rmcreds {
+    param([Parameter(ValueFromRemainingArguments)][string[]]$Arguments)
+
+    if ($Arguments -contains '--revoke' -and $env:OS_TOKEN) {
+        & oscreds revoke --quiet
+        if ($LASTEXITCODE -ne 0) {
+            Write-Host "Failed to revoke token" -ForegroundColor Red
+        }
+    }
+    Invoke-Expression ((& oscreds unset --shell powershell) -join "`n")
+}
+
+function prcreds {
+    Get-ChildItem Env:OS_* | Sort-Object Name | ForEach-Object {
+        if ($_.Name -match 'PASSWORD|TOKEN|SECRET') {
+            "$($_.Name)=******"
+        } else {
+            "$($_.Name)=$($_.Value)"
+        }
+    }
+}
+
+function os_creds {
+    if ($env:OS_CRED) { " $env:OS_CRED" }
+}
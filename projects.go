@@ -2,9 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
 	"sort"
 )
 
@@ -24,29 +21,8 @@ type ProjectsResponse struct {
 	} `json:"projects"`
 }
 
-func ListProjects(authURL, token string) ([]Project, error) {
-	url := getUrlPath(authURL, "/v3/auth/projects")
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Set("X-Auth-Token", token)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to list projects: %s - %s", resp.Status, string(body))
-	}
-
-	body, err := io.ReadAll(resp.Body)
+func (k *KeystoneClient) ListProjects(token string) ([]Project, error) {
+	body, err := k.get("/v3/auth/projects", token, nil)
 	if err != nil {
 		return nil, err
 	}
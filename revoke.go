@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// RevokeToken revokes a token, authenticating with the token itself
+func (k *KeystoneClient) RevokeToken(token string) error {
+	debugf("RevokeToken called (token length: %d)\n", len(token))
+	return k.delete("/v3/auth/tokens", token, map[string]string{
+		"X-Subject-Token": token,
+	})
+}
+
+// runRevoke revokes the token loaded in the environment and drops it from
+// the token cache, so it can't be reused after rmcreds
+func runRevoke(args []string) {
+	fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+	fs.BoolVar(&debugMode, "debug", false, "Enable debug output")
+	quiet := fs.Bool("quiet", false, "Only print errors, for use from the rmcreds shell function")
+	fs.Usage = func() {
+		printUsage(fs, "revoke [options]")
+	}
+	fs.Parse(args)
+
+	DebugMode = debugMode
+
+	creds := CredentialsFromEnv()
+	if creds.Token == "" {
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "No OS_TOKEN loaded, nothing to revoke\n")
+		}
+		return
+	}
+	if creds.AuthURL == "" {
+		fmt.Fprintf(os.Stderr, "Error: OS_AUTH_URL is not set\n")
+		os.Exit(1)
+	}
+
+	// Drop the token from the cache first, so it isn't handed out again even
+	// if Keystone can't be reached
+	if err := ClearCachedToken(creds.Token); err != nil {
+		debugf("Failed to remove token from cache: %v\n", err)
+	}
+
+	client, err := NewKeystoneClient(creds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring Keystone client: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = client.RevokeToken(creds.Token)
+	if IsKeystoneStatus(err, http.StatusNotFound, http.StatusUnauthorized) {
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Token for %s was already invalid\n", os.Getenv("OS_CRED"))
+		}
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error revoking token: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !*quiet {
+		fmt.Fprintf(os.Stderr, "Revoked token for %s\n", os.Getenv("OS_CRED"))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Secret reference prefixes for openrc values, e.g. OS_PASSWORD=pass:team/ldap
+const (
+	secretRefPass = "pass:"
+	secretRefCmd  = "cmd:"
+	secretRefEnv  = "env:"
+	// raw: keeps the rest of the value as it is, for literal secrets that
+	// start with one of the prefixes
+	secretRefRaw = "raw:"
+)
+
+// secretRefKeys are the variables that can hold secret references. Other
+// values are always literal, so a setting like OS_AUTH_URL can't run a
+// command.
+var secretRefKeys = map[string]bool{
+	"OS_PASSWORD":                      true,
+	"OS_APPLICATION_CREDENTIAL_SECRET": true,
+	"OS_CLIENT_SECRET":                 true,
+	"OS_TOKEN":                         true,
+	"OS_PASSCODE":                      true,
+}
+
+// resolveSecretRef returns the secret a reference points to, or the value
+// unchanged if it isn't a reference. pass: reads an entry from the credential
+// store, cmd: runs a command with sh and env: reads an environment variable.
+// raw: is removed, leaving the literal after it.
+func resolveSecretRef(store CredentialStore, value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretRefRaw):
+		return strings.TrimPrefix(value, secretRefRaw), nil
+
+	case strings.HasPrefix(value, secretRefPass):
+		entry := strings.TrimPrefix(value, secretRefPass)
+		if entry == "" {
+			return "", fmt.Errorf("empty pass: reference")
+		}
+		secret, err := store.Read(entry)
+		if err != nil {
+			return "", err
+		}
+		// The secret is the first line, as with pass show --clip, so the
+		// entry can hold notes after it
+		line, _, _ := strings.Cut(secret, "\n")
+		return strings.TrimSuffix(line, "\r"), nil
+
+	case strings.HasPrefix(value, secretRefCmd):
+		command := strings.TrimPrefix(value, secretRefCmd)
+		if command == "" {
+			return "", fmt.Errorf("empty cmd: reference")
+		}
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("command %q failed: %w", command, err)
+		}
+		return strings.TrimRight(string(output), "\r\n"), nil
+
+	case strings.HasPrefix(value, secretRefEnv):
+		name := strings.TrimPrefix(value, secretRefEnv)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q isn't set", name)
+		}
+		return secret, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// shellEmitter writes the code for a shell to set and unset environment
+// variables, which the shell functions evaluate
+type shellEmitter interface {
+	setVars(w io.Writer, vars []EnvVar)
+	unsetVars(w io.Writer, names []string)
+}
+
+// shells maps the --shell names to their emitters
+var shells = map[string]shellEmitter{
+	"bash":       posixShell,
+	"zsh":        posixShell,
+	"fish":       fishShell,
+	"powershell": powershellShell,
+	"pwsh":       powershellShell,
+	"nushell":    nushellShell{},
+	"nu":         nushellShell{},
+	"tcsh":       tcshShell,
+	"csh":        tcshShell,
+	"elvish":     elvishShell,
+}
+
+// shellNames lists the supported shells for errors and usage
+func shellNames() string {
+	var names []string
+	for name := range shells {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// currentShell returns the emitter for --shell, which has been validated
+func currentShell() shellEmitter {
+	return shells[shellType]
+}
+
+// lineShell emits one statement per variable
+type lineShell struct {
+	set   func(name, value string) string
+	unset func(name string) string
+}
+
+func (s lineShell) setVars(w io.Writer, vars []EnvVar) {
+	for _, v := range vars {
+		fmt.Fprintln(w, s.set(v.Key, v.Value))
+	}
+}
+
+func (s lineShell) unsetVars(w io.Writer, names []string) {
+	for _, name := range names {
+		fmt.Fprintln(w, s.unset(name))
+	}
+}
+
+var posixShell = lineShell{
+	set: func(name, value string) string {
+		return fmt.Sprintf("export %s=%s", name, bashEscape(value))
+	},
+	unset: func(name string) string {
+		return "unset " + name
+	},
+}
+
+var fishShell = lineShell{
+	set: func(name, value string) string {
+		return fmt.Sprintf("set -gx %s %s", name, fishEscape(value))
+	},
+	unset: func(name string) string {
+		return "set -eg " + name
+	},
+}
+
+var powershellShell = lineShell{
+	set: func(name, value string) string {
+		return fmt.Sprintf("$env:%s = %s", name, powershellEscape(value))
+	},
+	unset: func(name string) string {
+		return fmt.Sprintf("Remove-Item -Path Env:%s -ErrorAction SilentlyContinue", name)
+	},
+}
+
+// tcsh statements end in a semicolon, so they still work when the output is
+// run with eval and backquotes, which join the lines into one
+var tcshShell = lineShell{
+	set: func(name, value string) string {
+		return fmt.Sprintf("setenv %s %s;", name, tcshEscape(value))
+	},
+	unset: func(name string) string {
+		return "unsetenv " + name + ";"
+	},
+}
+
+var elvishShell = lineShell{
+	set: func(name, value string) string {
+		return fmt.Sprintf("set-env %s %s", name, elvishEscape(value))
+	},
+	unset: func(name string) string {
+		return "unset-env " + name
+	},
+}
+
+// nushellShell emits JSON, as nushell can't evaluate generated code at
+// runtime. The functions load it with `from json | load-env` and
+// `hide-env`.
+type nushellShell struct{}
+
+func (nushellShell) setVars(w io.Writer, vars []EnvVar) {
+	record := map[string]string{}
+	for _, v := range vars {
+		record[v.Key] = v.Value
+	}
+	data, _ := json.MarshalIndent(record, "", "  ")
+	fmt.Fprintln(w, string(data))
+}
+
+func (nushellShell) unsetVars(w io.Writer, names []string) {
+	if names == nil {
+		names = []string{}
+	}
+	data, _ := json.Marshal(names)
+	fmt.Fprintln(w, string(data))
+}
+
+func fishEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `'`, `\'`)
+	return "'" + s + "'"
+}
+
+func bashEscape(s string) string {
+	return "'" + strings.ReplaceAll(s, `'`, `'\''`) + "'"
+}
+
+// powershellEscape single quotes a string. PowerShell also treats the
+// typographic single quotes as quotes, so they are doubled too.
+func powershellEscape(s string) string {
+	var b strings.Builder
+	b.WriteString("'")
+	for _, r := range s {
+		switch r {
+		case '\'', '‘', '’', '‚', '‛':
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteString("'")
+	return b.String()
+}
+
+// tcshEscape single quotes a string. History substitution still applies
+// inside single quotes, and newlines have to be escaped.
+func tcshEscape(s string) string {
+	s = strings.ReplaceAll(s, `'`, `'\''`)
+	s = strings.ReplaceAll(s, "!", `\!`)
+	s = strings.ReplaceAll(s, "\n", "\\\n")
+	return "'" + s + "'"
+}
+
+func elvishEscape(s string) string {
+	return "'" + strings.ReplaceAll(s, `'`, `''`) + "'"
+}
+
+// dockerEnvValue returns the value as-is, as docker --env-file takes
+// everything after the = literally, which leaves no way to write a newline
+func dockerEnvValue(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n") {
+		return "", fmt.Errorf("value contains a newline")
+	}
+	return s, nil
+}
+
+// systemdEscape double quotes a value for a systemd EnvironmentFile, where
+// backslash escapes the characters that are special inside double quotes
+func systemdEscape(s string) (string, error) {
+	var b strings.Builder
+	b.WriteString(`"`)
+	for _, r := range s {
+		switch r {
+		case '\\', '"', '$', '`':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteString(`"`)
+	return b.String(), nil
+}
+
+// dotenvEscape single quotes a value for .env files, which dotenv libraries
+// take literally without interpolation. Values that can't be single quoted
+// are double quoted with the escapes dotenv libraries share. Those libraries
+// expand $VAR in double quotes, each with its own escape for it, so a $ can
+// only be written in single quotes.
+func dotenvEscape(s string) (string, error) {
+	if !strings.ContainsAny(s, "'\r\n") {
+		return "'" + s + "'", nil
+	}
+	if strings.Contains(s, "$") {
+		return "", fmt.Errorf("value contains a $ as well as a quote or newline")
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`, nil
+}
+
+// runUnset prints the code to remove every OS_* variable from the calling
+// shell, for the shell functions' rmcreds
+func runUnset(args []string) {
+	fs := flag.NewFlagSet("unset", flag.ExitOnError)
+	fs.StringVar(&shellType, "shell", "bash", "Shell type for output format ("+shellNames()+")")
+	fs.Usage = func() {
+		printUsage(fs, "unset [options]")
+	}
+	fs.Parse(args)
+
+	if _, ok := shells[shellType]; !ok {
+		fmt.Fprintf(os.Stderr, "Error: unsupported shell type %q (use %s)\n", shellType, shellNames())
+		os.Exit(1)
+	}
+
+	var names []string
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		if strings.HasPrefix(name, "OS_") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	currentShell().unsetVars(os.Stdout, names)
+}
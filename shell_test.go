@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+
+func TestEnvFileEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		escape  func(string) (string, error)
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"env plain", dockerEnvValue, "secret", "secret", false},
+		{"env quotes", dockerEnvValue, `a'b"c`, `a'b"c`, false},
+		{"env dollar", dockerEnvValue, "a$b${c}", "a$b${c}", false},
+		{"env backslash", dockerEnvValue, `a\nb`, `a\nb`, false},
+		{"env newline", dockerEnvValue, "a\nb", "", true},
+		{"env carriage return", dockerEnvValue, "a\rb", "", true},
+
+		{"systemd plain", systemdEscape, "secret", `"secret"`, false},
+		{"systemd quotes", systemdEscape, `a'b"c`, `"a'b\"c"`, false},
+		{"systemd dollar", systemdEscape, "a$b`c`", "\"a\\$b\\`c\\`\"", false},
+		{"systemd backslash", systemdEscape, `a\b`, `"a\\b"`, false},
+		{"systemd newline", systemdEscape, "a\nb", "\"a\nb\"", false},
+
+		{"dotenv plain", dotenvEscape, "secret", `'secret'`, false},
+		{"dotenv double quote", dotenvEscape, `a"b`, `'a"b'`, false},
+		{"dotenv dollar", dotenvEscape, "a$b${c}", `'a$b${c}'`, false},
+		{"dotenv backslash", dotenvEscape, `a\b`, `'a\b'`, false},
+		{"dotenv single quote", dotenvEscape, `a'b\c"d`, `"a'b\\c\"d"`, false},
+		{"dotenv newline", dotenvEscape, "a\nb\rc", `"a\nb\rc"`, false},
+		{"dotenv single quote and dollar", dotenvEscape, "a'b$c", "", true},
+		{"dotenv newline and dollar", dotenvEscape, "a\n$b", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.escape(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellEscapes(t *testing.T) {
+	tests := []struct {
+		name   string
+		escape func(string) string
+		value  string
+		want   string
+	}{
+		{"powershell plain", powershellEscape, "secret", `'secret'`},
+		{"powershell quote", powershellEscape, "a'b", `'a''b'`},
+		{"powershell history", powershellEscape, "a!b$c", `'a!b$c'`},
+		{"powershell typographic quote", powershellEscape, "a’b‘c", `'a’’b‘‘c'`},
+		{"powershell newline", powershellEscape, "a\nb", "'a\nb'"},
+
+		{"tcsh plain", tcshEscape, "secret", `'secret'`},
+		{"tcsh quote", tcshEscape, "a'b", `'a'\''b'`},
+		{"tcsh history", tcshEscape, "a!b$c", `'a\!b$c'`},
+		{"tcsh typographic quote", tcshEscape, "a’b", `'a’b'`},
+		{"tcsh newline", tcshEscape, "a\nb", "'a\\\nb'"},
+
+		{"elvish plain", elvishEscape, "secret", `'secret'`},
+		{"elvish quote", elvishEscape, "a'b", `'a''b'`},
+		{"elvish history", elvishEscape, "a!b$c", `'a!b$c'`},
+		{"elvish typographic quote", elvishEscape, "a’b", `'a’b'`},
+		{"elvish newline", elvishEscape, "a\nb", "'a\nb'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.escape(tt.value); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exit codes for oscreds status, following the Nagios plugin convention so
+// they can be used from monitoring and prompt scripts as well as the shell
+const (
+	statusValid    = 0
+	statusExpiring = 1
+	statusInvalid  = 2
+	statusUnknown  = 3
+)
+
+var statusNames = map[int]string{
+	statusValid:    "valid",
+	statusExpiring: "expiring",
+	statusInvalid:  "invalid",
+	statusUnknown:  "unknown",
+}
+
+// tokenStatus is the --json output of oscreds status
+type tokenStatus struct {
+	Status            string   `json:"status"`
+	Error             string   `json:"error,omitempty"`
+	Credential        string   `json:"credential,omitempty"`
+	UserID            string   `json:"user_id,omitempty"`
+	UserName          string   `json:"user_name,omitempty"`
+	UserDomainID      string   `json:"user_domain_id,omitempty"`
+	UserDomainName    string   `json:"user_domain_name,omitempty"`
+	ProjectID         string   `json:"project_id,omitempty"`
+	ProjectName       string   `json:"project_name,omitempty"`
+	ProjectDomainID   string   `json:"project_domain_id,omitempty"`
+	ProjectDomainName string   `json:"project_domain_name,omitempty"`
+	DomainID          string   `json:"domain_id,omitempty"`
+	DomainName        string   `json:"domain_name,omitempty"`
+	System            bool     `json:"system,omitempty"`
+	Roles             []string `json:"roles,omitempty"`
+	Methods           []string `json:"methods,omitempty"`
+	AuditIDs          []string `json:"audit_ids,omitempty"`
+	IssuedAt          string   `json:"issued_at,omitempty"`
+	ExpiresAt         string   `json:"expires_at,omitempty"`
+	SecondsRemaining  int64    `json:"seconds_remaining,omitempty"`
+}
+
+// ValidateToken checks a token with Keystone, returning its details. The
+// token authenticates its own validation request.
+func (k *KeystoneClient) ValidateToken(token string) (*TokenResponse, error) {
+	debugf("ValidateToken called (token length: %d)\n", len(token))
+
+	body, err := k.get("/v3/auth/tokens?nocatalog", token, map[string]string{
+		"X-Subject-Token": token,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenResponse TokenResponse
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %v", err)
+	}
+	return &tokenResponse, nil
+}
+
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.BoolVar(&debugMode, "debug", false, "Enable debug output")
+	jsonOutput := fs.Bool("json", false, "Print the token details as JSON")
+	warn := fs.Duration("warn", 15*time.Minute, "Report the token as expiring when it has less than this remaining")
+	fs.Usage = func() {
+		printUsage(fs, "status [options]")
+		fmt.Fprintf(fs.Output(), "\nExit status is 0 if the token is valid, 1 if it expires within --warn,\n2 if it is invalid or expired, and 3 if it could not be checked.\n")
+	}
+	fs.Parse(args)
+
+	DebugMode = debugMode
+
+	status := &tokenStatus{Credential: os.Getenv("OS_CRED")}
+	code := checkTokenStatus(status, *warn)
+	status.Status = statusNames[code]
+
+	if *jsonOutput {
+		data, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding status: %v\n", err)
+			os.Exit(statusUnknown)
+		}
+		fmt.Println(string(data))
+	} else {
+		printTokenStatus(status)
+	}
+
+	os.Exit(code)
+}
+
+// checkTokenStatus validates the token in the environment, filling in status
+// and returning the exit code
+func checkTokenStatus(status *tokenStatus, warn time.Duration) int {
+	creds := CredentialsFromEnv()
+	if creds.Token == "" {
+		status.Error = "no OS_TOKEN loaded"
+		return statusUnknown
+	}
+	if creds.AuthURL == "" {
+		status.Error = "OS_AUTH_URL is not set"
+		return statusUnknown
+	}
+
+	client, err := NewKeystoneClient(creds)
+	if err != nil {
+		status.Error = err.Error()
+		return statusUnknown
+	}
+
+	tokenResponse, err := client.ValidateToken(creds.Token)
+	if IsKeystoneStatus(err, http.StatusNotFound, http.StatusUnauthorized) {
+		status.Error = "token is expired or has been revoked"
+		return statusInvalid
+	}
+	if err != nil {
+		status.Error = err.Error()
+		return statusUnknown
+	}
+
+	token := tokenResponse.Token
+	status.UserID = token.User.ID
+	status.UserName = token.User.Name
+	status.UserDomainID = token.User.Domain.ID
+	status.UserDomainName = token.User.Domain.Name
+	status.ProjectID = token.Project.ID
+	status.ProjectName = token.Project.Name
+	status.ProjectDomainID = token.Project.Domain.ID
+	status.ProjectDomainName = token.Project.Domain.Name
+	status.DomainID = token.Domain.ID
+	status.DomainName = token.Domain.Name
+	status.System = token.System != nil
+	for _, role := range token.Roles {
+		status.Roles = append(status.Roles, role.Name)
+	}
+	status.Methods = token.Methods
+	status.AuditIDs = token.AuditIDs
+	status.IssuedAt = token.IssuedAt
+	status.ExpiresAt = token.Expires
+
+	expiresAt, err := tokenResponse.ExpiresAt()
+	if err != nil {
+		status.Error = fmt.Sprintf("failed to parse token expiry: %v", err)
+		return statusUnknown
+	}
+	remaining := time.Until(expiresAt)
+	status.SecondsRemaining = int64(remaining.Seconds())
+
+	if remaining <= 0 {
+		status.Error = "token has expired"
+		return statusInvalid
+	}
+	if remaining < warn {
+		return statusExpiring
+	}
+	return statusValid
+}
+
+// printTokenStatus prints a human readable summary of the token
+func printTokenStatus(status *tokenStatus) {
+	line := func(label, value string) {
+		if value != "" {
+			fmt.Printf("%-12s %s\n", label+":", value)
+		}
+	}
+	named := func(name, id string) string {
+		if name == "" {
+			return id
+		}
+		if id == "" {
+			return name
+		}
+		return fmt.Sprintf("%s (%s)", name, id)
+	}
+
+	line("Credential", status.Credential)
+	user := named(status.UserName, status.UserID)
+	if user != "" && status.UserDomainName != "" {
+		user += " in domain " + status.UserDomainName
+	}
+	line("User", user)
+
+	switch {
+	case status.System:
+		line("Scope", "system")
+	case status.ProjectID != "":
+		project := named(status.ProjectName, status.ProjectID)
+		if status.ProjectDomainName != "" {
+			project += " in domain " + status.ProjectDomainName
+		}
+		line("Project", project)
+	case status.DomainID != "":
+		line("Domain", named(status.DomainName, status.DomainID))
+	}
+
+	line("Roles", strings.Join(status.Roles, ", "))
+	if status.ExpiresAt != "" {
+		remaining := time.Duration(status.SecondsRemaining) * time.Second
+		line("Expires", fmt.Sprintf("%s (%s remaining)", status.ExpiresAt, remaining))
+	}
+	line("Methods", strings.Join(status.Methods, ", "))
+	line("Audit IDs", strings.Join(status.AuditIDs, ", "))
+
+	state := status.Status
+	if status.Error != "" {
+		state += " - " + status.Error
+	}
+	line("Status", state)
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// CredentialStore holds the encrypted openrc files. Entries are named by
+// their path in the store, such as team/prod.openrc.
+type CredentialStore interface {
+	// Name describes the store in messages
+	Name() string
+	// List returns the openrc entries in the store
+	List() ([]CredentialFile, error)
+	// Read returns the decrypted contents of an entry
+	Read(entry string) (string, error)
+	// Write encrypts and saves an entry, replacing any existing one
+	Write(entry, content string) error
+	// Exists reports whether an entry is in the store
+	Exists(entry string) bool
+}
+
+// Credential store types, selected in the config file or by OSCREDS_STORE
+const (
+	storePass   = "pass"
+	storeGPG    = "gpg"
+	storeAge    = "age"
+	storeGopass = "gopass"
+)
+
+var storeTypes = []string{storePass, storeGPG, storeAge, storeGopass}
+
+// OpenCredentialStore returns the store chosen by OSCREDS_STORE or the config
+// file, defaulting to pass
+func OpenCredentialStore() (CredentialStore, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	sc := config.Store
+
+	storeType := sc.Type
+	if env := os.Getenv("OSCREDS_STORE"); env != "" {
+		storeType = env
+	}
+	if storeType == "" {
+		storeType = storePass
+	}
+	debugf("Using the %s credential store\n", storeType)
+
+	switch storeType {
+	case storePass:
+		// Without pass installed, the store can still be read with gpg
+		if _, err := exec.LookPath("pass"); err != nil {
+			debugf("pass not found, decrypting with gpg directly\n")
+			return &gpgStore{dir: getPassDir()}, nil
+		}
+		return &passStore{dir: getPassDir()}, nil
+	case storeGPG:
+		dir := getPassDir()
+		if sc.Dir != "" {
+			dir = expandHome(sc.Dir)
+		}
+		return &gpgStore{dir: dir, recipients: sc.Recipients}, nil
+	case storeAge:
+		if sc.Dir == "" || sc.Identity == "" {
+			return nil, fmt.Errorf("the age store needs store.dir and store.identity set in the config file")
+		}
+		return &ageStore{dir: expandHome(sc.Dir), identity: expandHome(sc.Identity), recipients: sc.Recipients}, nil
+	case storeGopass:
+		return &gopassStore{}, nil
+	}
+	return nil, fmt.Errorf("unsupported credential store %q (use %s)", storeType, strings.Join(storeTypes, ", "))
+}
+
+// expandHome expands a leading ~ to the home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(homeDir, path[1:])
+}
+
+// listCredFiles finds the openrc entries in a directory of encrypted files
+// with the given extension, such as .gpg
+func listCredFiles(dir, ext string) ([]CredentialFile, error) {
+	var credFiles []CredentialFile
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		// Skip hidden directories, such as .git, as pass does
+		if info.IsDir() && path != dir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".openrc"+ext) {
+			relPath, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil
+			}
+
+			entry := filepath.ToSlash(strings.TrimSuffix(relPath, ext))
+
+			credFiles = append(credFiles, CredentialFile{
+				Path:        entry,
+				Type:        "openrc",
+				DisplayName: strings.TrimSuffix(entry, ".openrc"),
+			})
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(credFiles, func(i, j int) bool {
+		return credFiles[i].DisplayName < credFiles[j].DisplayName
+	})
+	return credFiles, nil
+}
+
+// checkEntry rejects entry names that lead outside the store
+func checkEntry(entry string) error {
+	clean := path.Clean(filepath.ToSlash(entry))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("entry %s is outside the credential store", entry)
+	}
+	return nil
+}
+
+// entryFile returns the encrypted file for an entry in a store directory
+func entryFile(dir, entry, ext string) (string, error) {
+	if err := checkEntry(entry); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, entry+ext), nil
+}
+
+// runStoreCommand runs a store's helper program, returning its output. Stderr
+// is kept apart so it can't end up in the credential, and is added to the
+// error if the program fails.
+func runStoreCommand(stdin []byte, env []string, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Env = env
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			msg = ": " + msg
+		}
+		return nil, fmt.Errorf("%s %s failed: %w%s", name, args[0], err, msg)
+	}
+	return output, nil
+}
+
+func getPassDir() string {
+	passDir := os.Getenv("PASSWORD_STORE_DIR")
+	if passDir == "" {
+		homeDir, _ := os.UserHomeDir()
+		passDir = filepath.Join(homeDir, ".password-store")
+	}
+	return passDir
+}
+
+// passStore reads and writes entries with pass
+type passStore struct {
+	dir string
+}
+
+func (s *passStore) Name() string {
+	return "pass"
+}
+
+func (s *passStore) List() ([]CredentialFile, error) {
+	return listCredFiles(s.dir, ".gpg")
+}
+
+func (s *passStore) Read(entry string) (string, error) {
+	output, err := runStoreCommand(nil, withPasswordStoreDir(os.Environ(), s.dir), "pass", "show", entry)
+	return string(output), err
+}
+
+// Write inserts a multi-line entry, overwriting any existing entry
+func (s *passStore) Write(entry, content string) error {
+	_, err := runStoreCommand([]byte(content), withPasswordStoreDir(os.Environ(), s.dir), "pass", "insert", "--multiline", "--force", entry)
+	return err
+}
+
+func (s *passStore) Exists(entry string) bool {
+	_, err := os.Stat(filepath.Join(s.dir, entry+".gpg"))
+	return err == nil
+}
+
+func withPasswordStoreDir(env []string, passDir string) []string {
+	const key = "PASSWORD_STORE_DIR="
+	out := make([]string, 0, len(env)+1)
+	found := false
+	for _, item := range env {
+		if strings.HasPrefix(item, key) {
+			out = append(out, key+passDir)
+			found = true
+			continue
+		}
+		out = append(out, item)
+	}
+	if !found {
+		out = append(out, key+passDir)
+	}
+	return out
+}
+
+// gpgStore is a directory of .openrc.gpg files, decrypted with gpg directly.
+// It reads and writes a password store the way pass does, without needing
+// pass installed.
+type gpgStore struct {
+	dir        string
+	recipients []string
+}
+
+func (s *gpgStore) Name() string {
+	return "gpg store " + s.dir
+}
+
+func (s *gpgStore) List() ([]CredentialFile, error) {
+	return listCredFiles(s.dir, ".gpg")
+}
+
+// gpgArgs returns the options pass gives gpg, followed by any in
+// PASSWORD_STORE_GPG_OPTS
+func gpgArgs(args ...string) []string {
+	args = append(args, "--quiet", "--yes", "--compress-algo=none", "--no-encrypt-to")
+	return append(args, strings.Fields(os.Getenv("PASSWORD_STORE_GPG_OPTS"))...)
+}
+
+func (s *gpgStore) Read(entry string) (string, error) {
+	file, err := entryFile(s.dir, entry, ".gpg")
+	if err != nil {
+		return "", err
+	}
+	args := append(gpgArgs("--decrypt"), file)
+	output, err := runStoreCommand(nil, os.Environ(), "gpg", args...)
+	return string(output), err
+}
+
+// gpgIDs returns the recipients for an entry from the nearest .gpg-id file
+// in its directory or above, as pass does
+func (s *gpgStore) gpgIDs(entry string) ([]string, error) {
+	dir := filepath.Dir(filepath.Join(s.dir, entry))
+	for {
+		data, err := os.ReadFile(filepath.Join(dir, ".gpg-id"))
+		if err == nil {
+			var ids []string
+			for _, line := range strings.Split(string(data), "\n") {
+				line, _, _ = strings.Cut(line, "#")
+				if line = strings.TrimSpace(line); line != "" {
+					ids = append(ids, line)
+				}
+			}
+			return ids, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		// Stop at the top of the store, or of the filesystem
+		rel, err := filepath.Rel(s.dir, dir)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// Write encrypts to the configured recipients, or those in .gpg-id, or to
+// the default key if there are none
+func (s *gpgStore) Write(entry, content string) error {
+	file, err := entryFile(s.dir, entry, ".gpg")
+	if err != nil {
+		return err
+	}
+
+	recipients := s.recipients
+	if len(recipients) == 0 {
+		if recipients, err = s.gpgIDs(entry); err != nil {
+			return err
+		}
+	}
+
+	args := gpgArgs("--encrypt")
+	if len(recipients) == 0 {
+		args = append(args, "--default-recipient-self")
+	}
+	for _, recipient := range recipients {
+		args = append(args, "--recipient", recipient)
+	}
+
+	output, err := runStoreCommand([]byte(content), os.Environ(), "gpg", args...)
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(file, output)
+}
+
+func (s *gpgStore) Exists(entry string) bool {
+	file, err := entryFile(s.dir, entry, ".gpg")
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(file)
+	return err == nil
+}
+
+// ageStore is a directory of .openrc.age files, decrypted with age
+type ageStore struct {
+	dir        string
+	identity   string
+	recipients []string
+}
+
+func (s *ageStore) Name() string {
+	return "age store " + s.dir
+}
+
+func (s *ageStore) List() ([]CredentialFile, error) {
+	return listCredFiles(s.dir, ".age")
+}
+
+func (s *ageStore) Read(entry string) (string, error) {
+	file, err := entryFile(s.dir, entry, ".age")
+	if err != nil {
+		return "", err
+	}
+	output, err := runStoreCommand(nil, os.Environ(), "age", "--decrypt", "--identity", s.identity, file)
+	return string(output), err
+}
+
+// Write encrypts to the configured recipients, or to the identity itself if
+// there are none
+func (s *ageStore) Write(entry, content string) error {
+	file, err := entryFile(s.dir, entry, ".age")
+	if err != nil {
+		return err
+	}
+
+	args := []string{"--encrypt"}
+	if len(s.recipients) == 0 {
+		args = append(args, "--identity", s.identity)
+	}
+	for _, recipient := range s.recipients {
+		args = append(args, "--recipient", recipient)
+	}
+
+	output, err := runStoreCommand([]byte(content), os.Environ(), "age", args...)
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(file, output)
+}
+
+func (s *ageStore) Exists(entry string) bool {
+	file, err := entryFile(s.dir, entry, ".age")
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(file)
+	return err == nil
+}
+
+// gopassStore reads and writes entries with gopass, which can hold several
+// stores and mounts that aren't plain directories
+type gopassStore struct{}
+
+func (s *gopassStore) Name() string {
+	return "gopass"
+}
+
+func (s *gopassStore) List() ([]CredentialFile, error) {
+	output, err := runStoreCommand(nil, os.Environ(), "gopass", "list", "--flat")
+	if err != nil {
+		return nil, err
+	}
+
+	var credFiles []CredentialFile
+	for _, entry := range strings.Split(string(output), "\n") {
+		entry = strings.TrimSpace(entry)
+		if !strings.HasSuffix(entry, ".openrc") {
+			continue
+		}
+		credFiles = append(credFiles, CredentialFile{
+			Path:        entry,
+			Type:        "openrc",
+			DisplayName: strings.TrimSuffix(entry, ".openrc"),
+		})
+	}
+
+	sort.Slice(credFiles, func(i, j int) bool {
+		return credFiles[i].DisplayName < credFiles[j].DisplayName
+	})
+	return credFiles, nil
+}
+
+// Read shows the entry without parsing, as gopass would otherwise treat the
+// first line as the password and the rest as key-value pairs
+func (s *gopassStore) Read(entry string) (string, error) {
+	output, err := runStoreCommand(nil, os.Environ(), "gopass", "show", "--noparsing", entry)
+	return string(output), err
+}
+
+func (s *gopassStore) Write(entry, content string) error {
+	_, err := runStoreCommand([]byte(content), os.Environ(), "gopass", "insert", "--force", entry)
+	return err
+}
+
+func (s *gopassStore) Exists(entry string) bool {
+	credFiles, err := s.List()
+	if err != nil {
+		return false
+	}
+	return FindCredentialFile(credFiles, entry).Path != ""
+}
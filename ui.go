@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	fzf "github.com/junegunn/fzf/src"
+	"golang.org/x/term"
 )
 
 const (
@@ -151,6 +152,18 @@ func SelectProject(projectsList []Project, credFile CredentialFile) *Project {
 	return &selected
 }
 
+func SelectRegion(regions []string, credFile CredentialFile) string {
+	cloudColour := getColourForText(credFile.DisplayName)
+
+	selected, ok := fzfSelect("Select region:", regions, func(region string) string {
+		return cloudColour + region + ColourReset
+	})
+	if !ok {
+		return ""
+	}
+	return selected
+}
+
 // getColourForText returns the appropriate colour code for text containing environment keywords
 func getColourForText(text string) string {
 	lowerText := strings.ToLower(text)
@@ -178,3 +191,60 @@ func PromptForTOTP() (string, error) {
 	}
 	return "", scanner.Err()
 }
+
+// PromptForPassword prompts the user to enter their password, without
+// echoing it
+func PromptForPassword(username string) (string, error) {
+	// Open /dev/tty to bypass stderr redirection
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to open /dev/tty: %v", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "Enter OpenStack password for %s: ", username)
+	password, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", err
+	}
+	return string(password), nil
+}
+
+// ShowDeviceAuthorization tells the user where to approve an OpenID Connect
+// device authorization request
+func ShowDeviceAuthorization(verificationURI, verificationURIComplete, userCode string) error {
+	// Open /dev/tty to bypass stderr redirection
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open /dev/tty: %v", err)
+	}
+	defer tty.Close()
+
+	if verificationURIComplete != "" {
+		fmt.Fprintf(tty, "To authenticate, visit:\n  %s\n", verificationURIComplete)
+		fmt.Fprintf(tty, "and check the code shown is %s\n", userCode)
+	} else {
+		fmt.Fprintf(tty, "To authenticate, visit:\n  %s\n", verificationURI)
+		fmt.Fprintf(tty, "and enter the code %s\n", userCode)
+	}
+	fmt.Fprint(tty, "Waiting for authorization...\n")
+	return nil
+}
+
+// ReadTokenFromStdin reads a Keystone token from the first non-empty line of
+// stdin
+func ReadTokenFromStdin() (string, error) {
+	scanner := bufio.NewScanner(os.Stdin)
+	// Fernet tokens are short, but PKI tokens can be several kilobytes
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if token := strings.TrimSpace(scanner.Text()); token != "" {
+			return token, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no token found on stdin")
+}